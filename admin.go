@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -48,20 +52,52 @@ func AdminIndexHandler(w http.ResponseWriter, r *http.Request) {
 func AdminMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	var errorMsg, successMsg string
 
+	form := &Message{}
+
 	err := r.ParseForm()
 	if err == nil && r.FormValue("slug") != "" {
-		msg := &Message{
-			Slug:     strings.ToLower(r.FormValue("slug")),
-			Message:  r.FormValue("body"),
-			Outgoing: 1,
+		admin, _, _ := r.BasicAuth()
+		id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+
+		// Edits keep the message's id and add a version, see saveVersion.
+		msg := &Message{ID: id}
+		if id != 0 {
+			if err := msg.Load(); err != nil || msg.Outgoing != 1 {
+				msg = &Message{}
+				errorMsg = "Invalid message."
+			}
 		}
 
-		if err := msg.Save(); err != nil {
+		msg.Slug = strings.ToLower(r.FormValue("slug"))
+		msg.Message = r.FormValue("body")
+		msg.Outgoing = 1
+		msg.Author = admin
+
+		if errorMsg != "" {
+			form = msg
+		} else if err := ValidateMessageTemplate(msg.Slug, msg.Message); err != nil {
+			errorMsg = err.Error()
+			form = msg
+		} else if err := CheckSegmentPolicy(msg.Message); err != nil {
+			errorMsg = err.Error()
+			form = msg
+		} else if err := msg.Save(); err != nil {
 			log.Println(err.Error())
-			errorMsg = "Unable to create message."
+			errorMsg = "Unable to save message."
+			form = msg
+		} else if id != 0 {
+			successMsg = "Message updated!"
 		} else {
 			successMsg = "Message created!"
 		}
+	} else if v := r.FormValue("edit"); v != "" {
+		id, _ := strconv.ParseInt(v, 10, 64)
+
+		form = &Message{ID: id}
+		if err := form.Load(); err != nil || form.Outgoing != 1 {
+			errorMsg = "Invalid message."
+			form = &Message{}
+		}
 	}
 
 	messageList, err := GetMessageList()
@@ -74,11 +110,15 @@ func AdminMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		Active      string
 		MessageList []*Message
+		Form        *Message
+		MaxSegments int
 		Success     string
 		Error       string
 	}{
 		Active:      "messages",
 		MessageList: messageList,
+		Form:        form,
+		MaxSegments: *MaxSegments,
 		Success:     successMsg,
 		Error:       errorMsg,
 	}
@@ -91,6 +131,173 @@ func AdminMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Every version of a message, with what changed and who changed it.
+func AdminMessageHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	msg := &Message{ID: id}
+	if err := msg.Load(); err != nil || msg.Slug == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	versions, err := GetMessageVersions(msg.ID)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal server error.", 500)
+		return
+	}
+
+	data := struct {
+		Active   string
+		Message  *Message
+		Versions []*MessageVersion
+	}{
+		Active:   "messages",
+		Message:  msg,
+		Versions: versions,
+	}
+
+	err = Templates.ExecuteTemplate(w, "admin_message_history", data)
+	if err != nil {
+		log.Println(err.Error())
+		http.NotFound(w, r)
+		return
+	}
+}
+
+// Measures a message body as it would be sent, for the editor's live count.
+// Rendered for the given user, or the sample recipient.
+func AdminMessageLengthHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	ctx := sampleMessageContext()
+
+	if username := r.FormValue("user"); username != "" {
+		parts := strings.Split(username, "@")
+		if len(parts) == 2 {
+			user := &User{UUID: parts[0], Network: parts[1]}
+			if err := user.Load(); err == nil {
+				ctx = newMessageContext(user, ctx.Params)
+			}
+		}
+	}
+
+	data := struct {
+		*SMSLength
+		MaxSegments int    `json:"max_segments"`
+		Body        string `json:"body"`
+		Error       string `json:"error"`
+	}{
+		MaxSegments: *MaxSegments,
+	}
+
+	body, err := ctx.Render(r.FormValue("body"))
+	if err != nil {
+		data.Error = strings.TrimPrefix(err.Error(), "template: ")
+		body = r.FormValue("body")
+	}
+
+	if *NormalizeChars {
+		body = NormalizeSmartChars(body)
+	}
+
+	data.Body = body
+	data.SMSLength = MeasureSMS(body)
+
+	jsonBytes, _ := json.Marshal(data)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonBytes)
+}
+
+// Shows a message rendered for a chosen user and sends tests to staff phones.
+func AdminMessagePreviewHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	msg := &Message{ID: id}
+	if err := msg.Load(); err != nil || msg.Slug == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var errorMsg, successMsg string
+
+	r.ParseForm()
+
+	var user *User
+	if username := r.FormValue("user"); username != "" {
+		parts := strings.Split(username, "@")
+		user = &User{UUID: parts[0]}
+		if len(parts) == 2 {
+			user.Network = parts[1]
+		}
+
+		if err := user.Load(); err != nil {
+			errorMsg = "Unknown user, showing the sample recipient."
+			user = nil
+		}
+	}
+
+	var body string
+
+	params, err := ParsePreviewParams(r.FormValue("params"))
+	if err == nil {
+		body, err = PreviewMessage(msg, user, params)
+	}
+
+	if err != nil {
+		errorMsg = strings.TrimPrefix(err.Error(), "template: ")
+	}
+
+	if r.Method == "POST" && r.FormValue("testNumber") != "" && err == nil {
+		parts := strings.Split(r.FormValue("testNumber"), "@")
+		if len(parts) != 2 {
+			errorMsg = "Invalid test number."
+		} else if err := SendTestMessage(body, &Recipient{UUID: parts[0], Network: parts[1]}); err != nil {
+			log.Println(err.Error())
+			errorMsg = "Unable to send test: " + err.Error()
+		} else {
+			successMsg = "Test sent to " + r.FormValue("testNumber") + "!"
+
+			if err := RecordAudit(r, "test_send", fmt.Sprintf("Sent test of %s to %s", msg.Slug, r.FormValue("testNumber"))); err != nil {
+				log.Println(err.Error())
+			}
+		}
+	}
+
+	data := struct {
+		Active      string
+		Message     *Message
+		Body        string
+		Length      *SMSLength
+		MaxSegments int
+		User        string
+		Params      string
+		TestNumbers []*Recipient
+		Success     string
+		Error       string
+	}{
+		Active:      "messages",
+		Message:     msg,
+		Body:        body,
+		Length:      MeasureSMS(body),
+		MaxSegments: *MaxSegments,
+		User:        r.FormValue("user"),
+		Params:      r.FormValue("params"),
+		TestNumbers: TestNumbers(),
+		Success:     successMsg,
+		Error:       errorMsg,
+	}
+
+	err = Templates.ExecuteTemplate(w, "admin_message_preview", data)
+	if err != nil {
+		log.Println(err.Error())
+		http.NotFound(w, r)
+		return
+	}
+}
+
 func AdminUserDetailHandler(w http.ResponseWriter, r *http.Request) {
 	var username string
 	var ok bool
@@ -113,19 +320,82 @@ func AdminUserDetailHandler(w http.ResponseWriter, r *http.Request) {
 
 	err := r.ParseForm()
 	if err == nil && r.FormValue("messageInput") != "" {
-		msg := &Message{
-			Slug:     MakeSlug("custom_" + username),
-			Message:  r.FormValue("messageInput"),
-			Outgoing: 1,
+		quietOK, quietReason := quietOverride(r)
+
+		if quietOK && quietReason == "" {
+			errorMsg = "A reason is required to send during quiet hours."
+		} else if auditQuietOverride(r, quietOK, fmt.Sprintf("Sent custom message to %s during quiet hours: %s", username, quietReason)) != nil {
+			errorMsg = "Unable to record the quiet hours override, nothing was sent."
+		} else if err := sendCustomMessage(user, r.FormValue("messageInput"), quietOK); err != nil {
+			log.Println(err.Error())
+			errorMsg = "Unable to send message: " + err.Error()
+		} else {
+			successMsg = "Message sent!"
+		}
+	}
+
+	if err == nil && r.FormValue("assign") != "" {
+		if err := AssignConversation(user.ID, r.FormValue("assignedTo")); err != nil {
+			log.Println(err.Error())
+			errorMsg = "Unable to assign conversation."
+		} else {
+			successMsg = "Conversation assigned!"
 		}
+	}
 
-		msg.AddTo(user.UUID, user.Network, nil)
+	if err == nil && r.FormValue("subscription") != "" && user.ID != 0 {
+		admin, _, _ := r.BasicAuth()
 
-		if err := msg.Send(); err != nil {
+		var err error
+		if r.FormValue("subscription") == "unsubscribe" {
+			consent := NewConsent(ConsentOptOut, ConsentSourceAdmin, r)
+			consent.Detail = "by " + admin
+			err = user.Unsubscribe(consent)
+		} else {
+			consent := NewConsent(ConsentResubscribe, ConsentSourceAdmin, r)
+			consent.Detail = "by " + admin
+			err = user.Resubscribe(consent)
+		}
+
+		if err != nil {
 			log.Println(err.Error())
-			errorMsg = "Unable to send message."
+			errorMsg = "Unable to update subscription."
 		} else {
-			successMsg = "Message sent!"
+			successMsg = "Subscription updated!"
+		}
+	}
+
+	if err == nil && r.FormValue("addTag") != "" && user.ID != 0 {
+		if err := user.AddTag(r.FormValue("addTag")); err != nil {
+			errorMsg = err.Error()
+		} else {
+			successMsg = "Tag added!"
+		}
+	}
+
+	if err == nil && r.FormValue("removeTag") != "" {
+		if err := user.RemoveTag(r.FormValue("removeTag")); err != nil {
+			log.Println(err.Error())
+			errorMsg = "Unable to remove tag."
+		} else {
+			successMsg = "Tag removed!"
+		}
+	}
+
+	if err == nil && r.FormValue("attrName") != "" && user.ID != 0 {
+		if err := user.SetAttribute(r.FormValue("attrName"), r.FormValue("attrValue"), r.FormValue("attrType")); err != nil {
+			errorMsg = err.Error()
+		} else {
+			successMsg = "Attribute saved!"
+		}
+	}
+
+	if err == nil && r.FormValue("removeAttr") != "" {
+		if err := user.RemoveAttribute(r.FormValue("removeAttr")); err != nil {
+			log.Println(err.Error())
+			errorMsg = "Unable to remove attribute."
+		} else {
+			successMsg = "Attribute removed!"
 		}
 	}
 
@@ -136,20 +406,55 @@ func AdminUserDetailHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Viewing the thread counts as reading it.
+	if err := MarkConversationRead(user.UUID, user.Network); err != nil {
+		log.Println(err.Error())
+	}
+
+	assignedTo, err := GetConversationAssignee(user.ID)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	consent, err := GetUserConsent(user.ID)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	tags, err := user.Tags()
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	attributes, err := user.Attributes()
+	if err != nil {
+		log.Println(err.Error())
+	}
+
 	data := struct {
-		Active   string
-		Success  string
-		Error    string
-		Username string
-		Thread   []*Message
-		User     *User
+		Active         string
+		Success        string
+		Error          string
+		Username       string
+		Thread         []*Message
+		User           *User
+		AssignedTo     string
+		Consent        []*Consent
+		Tags           []string
+		Attributes     []*UserAttribute
+		AttributeTypes []string
 	}{
-		Active:   "users",
-		Username: username,
-		User:     user,
-		Thread:   thread,
-		Success:  successMsg,
-		Error:    errorMsg,
+		Active:         "users",
+		Username:       username,
+		User:           user,
+		Thread:         thread,
+		AssignedTo:     assignedTo,
+		Consent:        consent,
+		Tags:           tags,
+		Attributes:     attributes,
+		AttributeTypes: []string{AttributeString, AttributeNumber, AttributeBoolean, AttributeDate},
+		Success:        successMsg,
+		Error:          errorMsg,
 	}
 
 	err = Templates.ExecuteTemplate(w, "admin_users_detail", data)
@@ -173,38 +478,55 @@ func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
 
 	err := r.ParseForm()
 	if err == nil && r.FormValue("toUsers") != "" {
-		sendOn := ""
+		// Send on is a wall clock time, applied in each recipient's own zone.
+		var sendOnTime time.Time
 		if r.FormValue("sendOn") != "" {
-			loc, _ := time.LoadLocation("Local")
-			sendOnTime, err := time.ParseInLocation("2006/01/02 15:04:05", r.FormValue("sendOn"), loc)
+			sendOnTime, err = time.Parse("2006/01/02 15:04:05", r.FormValue("sendOn"))
 
 			if err != nil {
 				log.Println(err.Error())
 				errorMsg = "Invalid send on date."
-			} else {
-				sendOn = sendOnTime.Format("2006-01-02 15:04:05")
 			}
 		}
 
+		quietOK, quietReason := quietOverride(r)
+		if quietOK && quietReason == "" {
+			errorMsg = "A reason is required to send during quiet hours."
+		}
+
 		if errorMsg == "" {
 			messageID, _ := strconv.ParseInt(r.FormValue("messageID"), 10, 64)
 
 			msg := &Message{
-				ID:     messageID,
-				SendOn: sendOn,
+				ID: messageID,
 			}
 
 			if err := msg.Load(); err != nil {
 				errorMsg = "Invalid message."
 			} else {
+				if quietOK {
+					msg.QuietOK = 1
+				}
+
 				for _, username := range strings.Split(r.FormValue("toUsers"), ";") {
 					if username != "" {
 						parts := strings.Split(username, "@")
 						msg.AddTo(parts[0], parts[1], nil)
+
+						if !sendOnTime.IsZero() {
+							user := &User{UUID: parts[0], Network: parts[1]}
+							user.Load()
+
+							mt := msg.To[len(msg.To)-1]
+							mt.SendOn = FormatDBTime(InLocation(sendOnTime, user.Location()))
+						}
 					}
 				}
 
-				if err := msg.Send(); err != nil {
+				detail := fmt.Sprintf("Sent %s to %d users during quiet hours: %s", msg.Slug, len(msg.To), quietReason)
+				if auditQuietOverride(r, quietOK, detail) != nil {
+					errorMsg = "Unable to record the quiet hours override, nothing was sent."
+				} else if err := msg.Send(); err != nil {
 					log.Println(err.Error())
 					errorMsg = "Unable to send message."
 				} else {
@@ -228,7 +550,7 @@ func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	var landing, state string
+	var landing, state, tag, attribute string
 
 	if v := params.Get("landing"); v != "" {
 		landing = v
@@ -238,6 +560,22 @@ func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
 		state = v
 	}
 
+	if v := params.Get("tag"); v != "" {
+		if _, err := NormalizeTag(v); err != nil {
+			errorMsg = err.Error()
+		} else {
+			tag = v
+		}
+	}
+
+	if v := params.Get("attr"); v != "" {
+		if _, _, err := attributeExprCondition(v); err != nil {
+			errorMsg = err.Error()
+		} else {
+			attribute = v
+		}
+	}
+
 	var limit int64 = 20
 	var offset int64 = 0
 	var page int64 = 1
@@ -258,7 +596,7 @@ func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
 	nextQuery.Set("page", strconv.FormatInt(page+1, 10))
 	nextLink = "?" + nextQuery.Encode()
 
-	userList, err := ListUsers(landing, state, "", limit, offset)
+	userList, err := ListUsers(landing, state, tag, attribute, "", limit, offset)
 	if err != nil {
 		log.Println(err.Error())
 		http.Error(w, "Internal server error.", 500)
@@ -286,8 +624,10 @@ func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
 		Prev        string
 		Next        string
 		Params      struct {
-			State   string
-			Landing string
+			State     string
+			Landing   string
+			Tag       string
+			Attribute string
 		}
 		Form struct {
 			MessageID int64
@@ -301,11 +641,15 @@ func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
 		Prev:     prevLink,
 		Next:     nextLink,
 		Params: struct {
-			State   string
-			Landing string
+			State     string
+			Landing   string
+			Tag       string
+			Attribute string
 		}{
-			State:   state,
-			Landing: landing,
+			State:     state,
+			Landing:   landing,
+			Tag:       tag,
+			Attribute: attribute,
 		},
 		Form:         formData,
 		LandingPages: landingPages,
@@ -321,3 +665,859 @@ func AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func AdminOutboundHandler(w http.ResponseWriter, r *http.Request) {
+	var errorMsg, successMsg string
+
+	err := r.ParseForm()
+	if err == nil && r.FormValue("requeue") != "" {
+		id, _ := strconv.ParseInt(r.FormValue("requeue"), 10, 64)
+
+		delivery := &Delivery{ID: id}
+		if err := delivery.Load(); err != nil {
+			errorMsg = "Invalid delivery."
+		} else if err := delivery.Requeue(); err != nil {
+			log.Println(err.Error())
+			errorMsg = "Unable to requeue delivery."
+		} else {
+			successMsg = "Delivery requeued!"
+		}
+	}
+
+	deadList, err := GetDeadDeliveries(100, 0)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal server error.", 500)
+		return
+	}
+
+	data := struct {
+		Active   string
+		DeadList []*Delivery
+		Success  string
+		Error    string
+	}{
+		Active:   "outbound",
+		DeadList: deadList,
+		Success:  successMsg,
+		Error:    errorMsg,
+	}
+
+	err = Templates.ExecuteTemplate(w, "admin_outbound", data)
+	if err != nil {
+		log.Println(err.Error())
+		http.NotFound(w, r)
+		return
+	}
+}
+
+// Attachments come from anyone who can email us, so nothing is served in a
+// way a browser would run it: only png, jpeg and gif are shown inline, the
+// rest are downloads, and the sandbox keeps even those off the admin origin.
+func AdminAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	path := mux.Vars(r)["path"]
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+
+	if contentType, ok := inlineImageTypes[filepath.Ext(path)]; ok {
+		w.Header().Set("Content-Type", contentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+
+	http.ServeFile(w, r, filepath.Join(*AttachmentDir, path))
+}
+
+func AdminUnknownInboundHandler(w http.ResponseWriter, r *http.Request) {
+	messageList, err := GetUnknownInbound(100, 0)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal server error.", 500)
+		return
+	}
+
+	data := struct {
+		Active      string
+		MessageList []*Message
+	}{
+		Active:      "unknown",
+		MessageList: messageList,
+	}
+
+	err = Templates.ExecuteTemplate(w, "admin_unknown", data)
+	if err != nil {
+		log.Println(err.Error())
+		http.NotFound(w, r)
+		return
+	}
+}
+
+func AdminInboxHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	var errorMsg, successMsg string
+
+	admin, _, _ := r.BasicAuth()
+
+	err := r.ParseForm()
+	if err == nil && r.FormValue("user") != "" {
+		userParts := strings.Split(r.FormValue("user"), "@")
+		user := &User{UUID: userParts[0]}
+		if len(userParts) > 1 {
+			user.Network = userParts[1]
+		}
+
+		if err := user.Load(); err != nil || user.ID == 0 {
+			errorMsg = "Invalid user."
+		} else if r.FormValue("messageInput") != "" {
+			if err := sendCustomMessage(user, r.FormValue("messageInput"), false); err != nil {
+				log.Println(err.Error())
+				errorMsg = "Unable to send message: " + err.Error()
+			} else {
+				if err := MarkConversationRead(user.UUID, user.Network); err != nil {
+					log.Println(err.Error())
+				}
+
+				successMsg = "Message sent!"
+			}
+		} else if r.FormValue("assign") != "" {
+			assignedTo := r.FormValue("assignedTo")
+			if r.FormValue("assign") == "me" {
+				assignedTo = admin
+			}
+
+			if err := AssignConversation(user.ID, assignedTo); err != nil {
+				log.Println(err.Error())
+				errorMsg = "Unable to assign conversation."
+			} else {
+				successMsg = "Conversation assigned!"
+			}
+		} else if r.FormValue("read") != "" {
+			if err := MarkConversationRead(user.UUID, user.Network); err != nil {
+				log.Println(err.Error())
+				errorMsg = "Unable to mark conversation read."
+			}
+		}
+	}
+
+	filter := ConversationFilter{
+		State:      params.Get("state"),
+		Landing:    params.Get("landing"),
+		AssignedTo: params.Get("assigned"),
+		UnreadOnly: params.Get("show") != "all",
+	}
+
+	var limit int64 = 20
+	var offset int64 = 0
+	var page int64 = 1
+	var prevLink string = "#"
+	var nextLink string = "#"
+	if v := params.Get("page"); v != "" {
+		page, _ = strconv.ParseInt(v, 10, 64)
+		offset = (page * limit) - limit
+	}
+
+	if offset != 0 {
+		prevQuery := r.URL.Query()
+		prevQuery.Set("page", strconv.FormatInt(page-1, 10))
+		prevLink = "?" + prevQuery.Encode()
+	}
+
+	nextQuery := r.URL.Query()
+	nextQuery.Set("page", strconv.FormatInt(page+1, 10))
+	nextLink = "?" + nextQuery.Encode()
+
+	conversations, err := ListConversations(filter, limit, offset)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal server error.", 500)
+		return
+	}
+
+	landingPages, err := GetLandingPages()
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	assignees, err := GetConversationAssignees()
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	data := struct {
+		Active        string
+		Conversations []*Conversation
+		Success       string
+		Error         string
+		Prev          string
+		Next          string
+		Admin         string
+		Params        struct {
+			State    string
+			Landing  string
+			Assigned string
+			Show     string
+		}
+		LandingPages []string
+		Assignees    []string
+	}{
+		Active:        "inbox",
+		Conversations: conversations,
+		Prev:          prevLink,
+		Next:          nextLink,
+		Admin:         admin,
+		Params: struct {
+			State    string
+			Landing  string
+			Assigned string
+			Show     string
+		}{
+			State:    filter.State,
+			Landing:  filter.Landing,
+			Assigned: filter.AssignedTo,
+			Show:     params.Get("show"),
+		},
+		LandingPages: landingPages,
+		Assignees:    assignees,
+		Success:      successMsg,
+		Error:        errorMsg,
+	}
+
+	err = Templates.ExecuteTemplate(w, "admin_inbox", data)
+	if err != nil {
+		log.Println(err.Error())
+		http.NotFound(w, r)
+		return
+	}
+}
+
+// Sends a one-off message typed by an admin to a single user.
+func sendCustomMessage(user *User, body string, quietOK bool) error {
+	msg := &Message{
+		Slug:     MakeSlug("custom_" + user.UUID + "@" + user.Network),
+		Message:  body,
+		Outgoing: 1,
+	}
+
+	if quietOK {
+		msg.QuietOK = 1
+	}
+
+	if err := ValidateMessageTemplate(msg.Slug, body); err != nil {
+		return err
+	}
+
+	msg.AddTo(user.UUID, user.Network, nil)
+
+	return msg.Send()
+}
+
+func AdminRulesHandler(w http.ResponseWriter, r *http.Request) {
+	var errorMsg, successMsg string
+
+	test := struct {
+		Text    string
+		State   string
+		Matched map[int64]bool
+		Winner  *ResponderRule
+		Pending *ResponderRule
+	}{
+		Matched: map[int64]bool{},
+	}
+
+	rule := &ResponderRule{MatchType: RuleMatchKeyword}
+
+	err := r.ParseForm()
+	if err == nil {
+		id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+
+		switch r.FormValue("action") {
+		case "create":
+			priority, _ := strconv.Atoi(r.FormValue("priority"))
+
+			rule = &ResponderRule{
+				Name:      r.FormValue("name"),
+				MatchType: r.FormValue("matchType"),
+				Pattern:   r.FormValue("pattern"),
+				State:     strings.ToUpper(r.FormValue("state")),
+				ReplySlug: strings.ToLower(r.FormValue("replySlug")),
+				Tag:       r.FormValue("tag"),
+				Attribute: r.FormValue("attribute"),
+				Priority:  priority,
+			}
+
+			// New rules start disabled so they can be tested first.
+			if err := rule.Save(); err != nil {
+				errorMsg = err.Error()
+			} else {
+				successMsg = "Rule created! Test it below, then enable it."
+				rule = &ResponderRule{MatchType: RuleMatchKeyword}
+			}
+		case "enable", "disable":
+			enabled := 0
+			if r.FormValue("action") == "enable" {
+				enabled = 1
+			}
+
+			if err := (&ResponderRule{ID: id}).SetEnabled(enabled); err != nil {
+				log.Println(err.Error())
+				errorMsg = "Unable to update rule."
+			} else {
+				successMsg = "Rule updated!"
+			}
+		case "delete":
+			if err := (&ResponderRule{ID: id}).Delete(); err != nil {
+				log.Println(err.Error())
+				errorMsg = "Unable to delete rule."
+			} else {
+				successMsg = "Rule deleted!"
+			}
+		case "test":
+			test.Text = r.FormValue("sampleText")
+			test.State = strings.ToUpper(r.FormValue("sampleState"))
+		}
+	}
+
+	rules, err := GetResponderRules(false)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal server error.", 500)
+		return
+	}
+
+	if test.Text != "" {
+		for _, rule := range rules {
+			test.Matched[rule.ID] = rule.Matches(test.Text, test.State)
+		}
+
+		// Keywords take precedence over rules, as they do for real replies,
+		// and only enabled rules answer. Pending is the disabled rule that
+		// would take over once it's enabled.
+		if InboundKeyword(test.Text) == "" {
+			enabled := []*ResponderRule{}
+			for _, rule := range rules {
+				if rule.Enabled == 1 {
+					enabled = append(enabled, rule)
+				}
+			}
+
+			test.Winner = MatchResponderRule(enabled, test.Text, test.State)
+
+			if rule := MatchResponderRule(rules, test.Text, test.State); rule != nil && rule.Enabled == 0 {
+				test.Pending = rule
+			}
+		}
+	}
+
+	messageList, err := GetMessageList()
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	data := struct {
+		Active      string
+		Rules       []*ResponderRule
+		Form        *ResponderRule
+		MessageList []*Message
+		Test        struct {
+			Text    string
+			State   string
+			Matched map[int64]bool
+			Winner  *ResponderRule
+			Pending *ResponderRule
+		}
+		Keyword string
+		Success string
+		Error   string
+	}{
+		Active:      "rules",
+		Rules:       rules,
+		Form:        rule,
+		MessageList: messageList,
+		Test:        test,
+		Keyword:     InboundKeyword(test.Text),
+		Success:     successMsg,
+		Error:       errorMsg,
+	}
+
+	err = Templates.ExecuteTemplate(w, "admin_rules", data)
+	if err != nil {
+		log.Println(err.Error())
+		http.NotFound(w, r)
+		return
+	}
+}
+
+// The user's consent ledger as CSV, for legal requests.
+func AdminConsentExportHandler(w http.ResponseWriter, r *http.Request) {
+	userParts := strings.Split(mux.Vars(r)["user"], "@")
+	user := &User{
+		UUID:    userParts[0],
+		Network: userParts[1],
+	}
+
+	if user.Load(); user.ID == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	ledger, err := GetUserConsent(user.ID)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal server error.", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"consent_"+user.UUID+"_"+user.Network+".csv\"")
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "user_id", "network", "uuid", "event", "source", "ip", "user_agent", "terms_version", "detail", "created_on"})
+
+	for _, c := range ledger {
+		out.Write([]string{
+			strconv.FormatInt(c.ID, 10),
+			strconv.FormatInt(c.UserID, 10),
+			c.Network,
+			c.UUID,
+			c.Event,
+			c.Source,
+			c.IP,
+			c.UserAgent,
+			c.TermsVersion,
+			c.Detail,
+			c.CreatedOn,
+		})
+	}
+
+	out.Flush()
+}
+
+// The user's whole thread as CSV, with outgoing messages as they were
+// actually sent.
+func AdminThreadExportHandler(w http.ResponseWriter, r *http.Request) {
+	userParts := strings.Split(mux.Vars(r)["user"], "@")
+	user := &User{
+		UUID:    userParts[0],
+		Network: userParts[1],
+	}
+
+	if user.Load(); user.ID == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	thread, err := GetUserThread(user.UUID, user.Network)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal server error.", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"thread_"+user.UUID+"_"+user.Network+".csv\"")
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "direction", "slug", "version", "body", "status", "status_detail", "transport", "provider_id", "provider_response", "created_on", "sent_on", "re_rendered"})
+
+	for _, msg := range thread {
+		mt := msg.To[0]
+		mt.user = user
+
+		// Sends from before bodies were kept are rendered again, which may
+		// not be exactly what went out.
+		direction, reRendered := "inbound", "0"
+		if msg.Outgoing == 1 {
+			direction = "outbound"
+			if mt.SentBody == "" {
+				reRendered = "1"
+			}
+		}
+
+		body := mt.Body(msg)
+
+		out.Write([]string{
+			strconv.FormatInt(mt.ID, 10),
+			direction,
+			msg.Slug,
+			strconv.Itoa(msg.Version),
+			body,
+			mt.Status,
+			mt.StatusDetail,
+			mt.Transport,
+			mt.ProviderID,
+			mt.ProviderResponse,
+			msg.CreatedOn,
+			mt.SentOn,
+			reRendered,
+		})
+	}
+
+	out.Flush()
+}
+
+// Whether the admin asked to send through quiet hours, and why.
+func quietOverride(r *http.Request) (bool, string) {
+	return r.FormValue("quietOverride") == "1", strings.TrimSpace(r.FormValue("quietReason"))
+}
+
+// Audits a quiet hours override. Overrides aren't allowed without a record of
+// them, so nothing should be sent if this fails.
+func auditQuietOverride(r *http.Request, quietOK bool, detail string) error {
+	if !quietOK {
+		return nil
+	}
+
+	err := RecordAudit(r, "quiet_hours_override", detail)
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	return err
+}
+
+func AdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := GetAuditLog(200, 0)
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal server error.", 500)
+		return
+	}
+
+	data := struct {
+		Active  string
+		Entries []*AuditEntry
+	}{
+		Active:  "audit",
+		Entries: entries,
+	}
+
+	err = Templates.ExecuteTemplate(w, "admin_audit", data)
+	if err != nil {
+		log.Println(err.Error())
+		http.NotFound(w, r)
+		return
+	}
+}
+
+func AdminCampaignsHandler(w http.ResponseWriter, r *http.Request) {
+	var errorMsg, successMsg string
+
+	form := &Campaign{Audience: map[string]string{}}
+
+	err := r.ParseForm()
+	if err == nil && r.FormValue("action") == "create" {
+		admin, _, _ := r.BasicAuth()
+		messageID, _ := strconv.ParseInt(r.FormValue("messageID"), 10, 64)
+
+		segmentID, _ := strconv.ParseInt(r.FormValue("segmentID"), 10, 64)
+
+		form = &Campaign{
+			Name:      r.FormValue("name"),
+			MessageID: messageID,
+			SegmentID: segmentID,
+			Audience:  map[string]string{},
+			SendOn:    r.FormValue("sendOn"),
+			CreatedBy: admin,
+		}
+
+		if segmentID != 0 {
+			segment := &Segment{ID: segmentID}
+			if err := segment.Load(); err != nil {
+				errorMsg = "Invalid segment."
+			}
+
+			for k, v := range segment.Filters {
+				form.Audience[k] = v
+			}
+		}
+
+		if v := r.FormValue("state"); v != "" {
+			form.Audience["state"] = v
+		}
+
+		if v := r.FormValue("landing"); v != "" {
+			form.Audience["landing_page"] = v
+		}
+
+		quietOK, quietReason := quietOverride(r)
+		if quietOK {
+			form.QuietOK = 1
+		}
+
+		if quietOK && quietReason == "" {
+			errorMsg = "A reason is required to send during quiet hours."
+		}
+
+		// Recorded before the campaign starts, it can't be once it has.
+		if errorMsg == "" {
+			detail := fmt.Sprintf("Campaign %q allowed to send during quiet hours: %s", form.Name, quietReason)
+			if auditQuietOverride(r, quietOK, detail) != nil {
+				errorMsg = "Unable to record the quiet hours override, the campaign wasn't started."
+			}
+		}
+
+		if errorMsg == "" {
+			if err := form.Save(); err != nil {
+				errorMsg = err.Error()
+			} else {
+				successMsg = "Campaign started!"
+				form = &Campaign{Audience: map[string]string{}}
+			}
+		}
+	} else if err == nil && r.FormValue("action") != "" {
+		id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+
+		status := map[string]string{
+			"pause":  CampaignPaused,
+			"resume": CampaignRunning,
+			"cancel": CampaignCancelled,
+		}[r.FormValue("action")]
+
+		campaign := &Campaign{ID: id}
+		if changed, err := campaign.SetStatus(status); err != nil {
+			log.Println(err.Error())
+			errorMsg = "Unable to update campaign."
+		} else if !changed {
+			errorMsg = "Campaign can't be changed from its current status."
+		} else {
+			successMsg = "Campaign " + status + "."
+		}
+	}
+
+	campaigns, err := GetCampaigns("")
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal server error.", 500)
+		return
+	}
+
+	for _, c := range campaigns {
+		if err := c.LoadReport(); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	messageList, err := GetMessageList()
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	landingPages, err := GetLandingPages()
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	messages := map[int64]string{}
+	for _, m := range messageList {
+		messages[m.ID] = m.Slug
+	}
+
+	segments, err := GetSegments()
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	data := struct {
+		Active       string
+		Campaigns    []*Campaign
+		Messages     map[int64]string
+		MessageList  []*Message
+		LandingPages []string
+		Segments     []*Segment
+		Form         *Campaign
+		Success      string
+		Error        string
+	}{
+		Active:       "campaigns",
+		Segments:     segments,
+		Campaigns:    campaigns,
+		Messages:     messages,
+		MessageList:  messageList,
+		LandingPages: landingPages,
+		Form:         form,
+		Success:      successMsg,
+		Error:        errorMsg,
+	}
+
+	err = Templates.ExecuteTemplate(w, "admin_campaigns", data)
+	if err != nil {
+		log.Println(err.Error())
+		http.NotFound(w, r)
+		return
+	}
+}
+
+func AdminSegmentsHandler(w http.ResponseWriter, r *http.Request) {
+	var errorMsg, successMsg string
+
+	form := &Segment{Filters: map[string]string{}}
+	var preview int64 = -1
+
+	err := r.ParseForm()
+	if err == nil {
+		id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+
+		switch r.FormValue("action") {
+		case "preview", "save":
+			form = &Segment{ID: id, Name: r.FormValue("name"), Filters: segmentFilters(r)}
+
+			if r.FormValue("action") == "preview" {
+				if err := ValidateAudience(form.Filters); err != nil {
+					errorMsg = err.Error()
+				} else if preview, err = CountAudience(form.Filters); err != nil {
+					log.Println(err.Error())
+					errorMsg = "Unable to count segment."
+				}
+			} else if err := form.Save(); err != nil {
+				errorMsg = err.Error()
+			} else {
+				successMsg = "Segment saved!"
+				form = &Segment{Filters: map[string]string{}}
+			}
+		case "edit":
+			form = &Segment{ID: id}
+			if err := form.Load(); err != nil {
+				errorMsg = "Invalid segment."
+				form = &Segment{Filters: map[string]string{}}
+			}
+		case "delete":
+			if err := (&Segment{ID: id}).Delete(); err != nil {
+				log.Println(err.Error())
+				errorMsg = "Unable to delete segment."
+			} else {
+				successMsg = "Segment deleted!"
+			}
+		}
+	}
+
+	segments, err := GetSegments()
+	if err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal server error.", 500)
+		return
+	}
+
+	for _, s := range segments {
+		if s.Count, err = CountAudience(s.Filters); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	landingPages, err := GetLandingPages()
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	messageList, err := GetMessageList()
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	attributes, err := GetAttributes()
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	data := struct {
+		Active       string
+		Segments     []*Segment
+		Filters      map[string]string
+		Form         *Segment
+		Preview      int64
+		LandingPages []string
+		MessageList  []*Message
+		Attributes   []*Attribute
+		Success      string
+		Error        string
+	}{
+		Active:       "segments",
+		Segments:     segments,
+		Filters:      audienceFilters,
+		Form:         form,
+		Preview:      preview,
+		LandingPages: landingPages,
+		MessageList:  messageList,
+		Attributes:   attributes,
+		Success:      successMsg,
+		Error:        errorMsg,
+	}
+
+	err = Templates.ExecuteTemplate(w, "admin_segments", data)
+	if err != nil {
+		log.Println(err.Error())
+		http.NotFound(w, r)
+		return
+	}
+}
+
+// The users in a segment as CSV.
+func AdminSegmentExportHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	segment := &Segment{ID: id}
+	if err := segment.Load(); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"segment_"+strconv.FormatInt(segment.ID, 10)+".csv\"")
+
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "network", "uuid", "name", "state", "zipcode", "landing_page", "message_window", "timezone", "news", "reminders", "created_on"})
+
+	var afterID int64
+	for {
+		users, err := ListAudienceUsers(segment.Filters, afterID, 1000)
+		if err != nil {
+			log.Println(err.Error())
+			break
+		}
+
+		if len(users) == 0 {
+			break
+		}
+
+		for _, u := range users {
+			out.Write([]string{
+				strconv.FormatInt(u.ID, 10),
+				u.Network,
+				u.UUID,
+				u.Name,
+				u.State,
+				strconv.Itoa(u.Zipcode),
+				u.LandingPage,
+				u.MessageWindow,
+				u.Timezone,
+				strconv.Itoa(u.News),
+				strconv.Itoa(u.Reminders),
+				u.CreatedOn,
+			})
+		}
+
+		afterID = users[len(users)-1].ID
+	}
+
+	out.Flush()
+}
+
+func segmentFilters(r *http.Request) map[string]string {
+	filters := map[string]string{}
+
+	for k := range audienceFilters {
+		if v := strings.TrimSpace(r.FormValue(k)); v != "" {
+			filters[k] = v
+		}
+	}
+
+	for k := range r.Form {
+		if v := strings.TrimSpace(r.FormValue(k)); strings.HasPrefix(k, "attr_") && v != "" {
+			filters[k] = v
+		}
+	}
+
+	return filters
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Attachments are stored on disk under -attachments, named by the SHA-1 of
+// their content, and referenced from the attachment table.
+type Attachment struct {
+	ID            int64  `json:"id"`
+	UserMessageID int64  `json:"user_message_id"`
+	ContentType   string `json:"content_type"`
+	Filename      string `json:"filename"`
+	Path          string `json:"path"`
+	Truncated     int    `json:"truncated"`
+	CreatedOn     string `json:"created_on"`
+	Data          []byte `json:"-"`
+}
+
+func GetUserAttachments(uuid string, network string) (map[int64][]*Attachment, error) {
+	db := NewMySQL()
+
+	attachments := map[int64][]*Attachment{}
+
+	result, err := db.Select(`SELECT a.id, a.user_message_id, a.content_type, a.filename, a.path, a.truncated, a.created_on
+		FROM attachment AS a
+		JOIN user_message AS um ON (um.id = a.user_message_id)
+		WHERE um.uuid=? AND um.network=?`, uuid, network)
+	if err != nil {
+		return attachments, err
+	}
+
+	for result.Next() {
+		a := &Attachment{}
+
+		err := result.Scan(&a.ID, &a.UserMessageID, &a.ContentType, &a.Filename, &a.Path, &a.Truncated, &a.CreatedOn)
+		if err != nil {
+			return attachments, err
+		}
+
+		attachments[a.UserMessageID] = append(attachments[a.UserMessageID], a)
+	}
+
+	return attachments, nil
+}
+
+// The only types shown inline in the admin, keyed by the extension they're
+// stored with. Anything else, whatever the sender says it is, is stored
+// without an extension and only ever downloaded.
+// Older attachments were named from the sender's type, hence .jpe and .jpeg.
+var inlineImageTypes map[string]string = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpe":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+}
+
+// The stored extension for data, from what it actually contains.
+func attachmentExt(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/png":
+		return ".png"
+	case "image/jpeg":
+		return ".jpg"
+	case "image/gif":
+		return ".gif"
+	}
+
+	return ""
+}
+
+func (this *Attachment) IsImage() bool {
+	_, ok := inlineImageTypes[filepath.Ext(this.Path)]
+	return ok
+}
+
+// Writes the attachment data to disk and records it.
+func (this *Attachment) Save() error {
+	if this.UserMessageID == 0 || len(this.Data) == 0 {
+		return errors.New("Attachment record not complete enough to save.")
+	}
+
+	this.Path = fmt.Sprintf("%x%s", sha1.Sum(this.Data), attachmentExt(this.Data))
+
+	if err := os.MkdirAll(*AttachmentDir, 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(*AttachmentDir, this.Path), this.Data, 0644); err != nil {
+		return err
+	}
+
+	db := NewMySQL()
+
+	newID, err := db.Insert(
+		"INSERT INTO attachment SET user_message_id=?, content_type=?, filename=?, path=?, truncated=?",
+		this.UserMessageID,
+		this.ContentType,
+		this.Filename,
+		this.Path,
+		this.Truncated,
+	)
+	if err != nil {
+		return err
+	}
+
+	this.ID = newID
+
+	return nil
+}
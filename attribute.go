@@ -0,0 +1,377 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Custom attributes are typed values on a user, like first_time_voter=true
+// or household_size=3. Each attribute name has one type, fixed when it's
+// first used.
+type Attribute struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	CreatedOn string `json:"created_on"`
+}
+
+type UserAttribute struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+const (
+	AttributeString  = "string"
+	AttributeNumber  = "number"
+	AttributeBoolean = "boolean"
+	AttributeDate    = "date"
+)
+
+var attributeTypes map[string]bool = map[string]bool{
+	AttributeString:  true,
+	AttributeNumber:  true,
+	AttributeBoolean: true,
+	AttributeDate:    true,
+}
+
+var attributeNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+// Filters compare with an optional operator before the value, e.g. ">=3".
+// "!" is short for "!=", for places where = can't be used.
+var attributeFilterPattern = regexp.MustCompile(`^(!=|!|>=|<=|=|>|<)?(.*)$`)
+
+// Or, with the name in front, "household_size>=3".
+var attributeExprPattern = regexp.MustCompile(`^([a-z][a-z0-9_]*)\s*((?:!|>|<|=).*)$`)
+
+func GetAttributes() ([]*Attribute, error) {
+	db := NewMySQL()
+
+	result, err := db.Select("SELECT name, type, created_on FROM attribute ORDER BY name")
+	if err != nil {
+		return []*Attribute{}, err
+	}
+
+	attributes := []*Attribute{}
+
+	for result.Next() {
+		a := &Attribute{}
+		if err := result.Scan(&a.Name, &a.Type, &a.CreatedOn); err != nil {
+			return attributes, err
+		}
+
+		attributes = append(attributes, a)
+	}
+
+	return attributes, nil
+}
+
+func (this *Attribute) Load() error {
+	db := NewMySQL()
+
+	result, err := db.Select("SELECT name, type, created_on FROM attribute WHERE name=? LIMIT 1", this.Name)
+	if err != nil {
+		return err
+	}
+
+	for result.Next() {
+		if err := result.Scan(&this.Name, &this.Type, &this.CreatedOn); err != nil {
+			return err
+		}
+	}
+
+	if this.CreatedOn == "" {
+		return errors.New("Attribute not found: " + this.Name)
+	}
+
+	return nil
+}
+
+func (this *Attribute) Save() error {
+	if !attributeNamePattern.MatchString(this.Name) {
+		return errors.New("Attribute names must be lowercase letters, numbers and underscores.")
+	}
+
+	if !attributeTypes[this.Type] {
+		return errors.New("Unknown attribute type: " + this.Type)
+	}
+
+	db := NewMySQL()
+
+	_, err := db.Insert("INSERT IGNORE INTO attribute SET name=?, type=?", this.Name, this.Type)
+
+	return err
+}
+
+// Checks a value against the attribute's type and returns it in the form
+// it's stored in.
+func (this *Attribute) Normalize(value string) (string, error) {
+	value = strings.TrimSpace(value)
+
+	switch this.Type {
+	case AttributeNumber:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "", errors.New(this.Name + " must be a number.")
+		}
+
+		return strconv.FormatFloat(n, 'f', -1, 64), nil
+	case AttributeBoolean:
+		switch strings.ToLower(value) {
+		case "true", "yes", "y", "1":
+			return "true", nil
+		case "false", "no", "n", "0":
+			return "false", nil
+		}
+
+		return "", errors.New(this.Name + " must be true or false.")
+	case AttributeDate:
+		if _, err := time.Parse(audienceDateFormat, value); err != nil {
+			return "", errors.New(this.Name + " must be a date, YYYY-MM-DD.")
+		}
+	}
+
+	if len(value) > 255 {
+		return "", errors.New(this.Name + " is too long.")
+	}
+
+	return value, nil
+}
+
+// Sets an attribute on the user. An attribute that doesn't exist yet is
+// created with typ, which is ignored for existing attributes.
+func (this *User) SetAttribute(name string, value string, typ string) error {
+	if this.ID == 0 {
+		return errors.New("User must be saved before attributes can be set.")
+	}
+
+	attr := &Attribute{Name: strings.ToLower(strings.TrimSpace(name))}
+	if err := attr.Load(); err != nil {
+		if typ == "" {
+			typ = AttributeString
+		}
+
+		attr.Type = typ
+		if err := attr.Save(); err != nil {
+			return err
+		}
+
+		// Someone else may have created it first with another type.
+		if err := attr.Load(); err != nil {
+			return err
+		}
+	}
+
+	value, err := attr.Normalize(value)
+	if err != nil {
+		return err
+	}
+
+	db := NewMySQL()
+
+	_, err = db.Insert(
+		"INSERT INTO user_attribute SET user_id=?, name=?, value=? ON DUPLICATE KEY UPDATE value=VALUES(value)",
+		this.ID,
+		attr.Name,
+		value,
+	)
+
+	return err
+}
+
+func (this *User) RemoveAttribute(name string) error {
+	db := NewMySQL()
+
+	_, err := db.Update("DELETE FROM user_attribute WHERE user_id=? AND name=?", this.ID, name)
+
+	return err
+}
+
+func (this *User) Attributes() ([]*UserAttribute, error) {
+	db := NewMySQL()
+
+	attributes := []*UserAttribute{}
+
+	result, err := db.Select(`SELECT ua.name, IFNULL(a.type, ?), ua.value
+		FROM user_attribute AS ua
+		LEFT JOIN attribute AS a ON (a.name = ua.name)
+		WHERE ua.user_id=? ORDER BY ua.name`, AttributeString, this.ID)
+	if err != nil {
+		return attributes, err
+	}
+
+	for result.Next() {
+		a := &UserAttribute{}
+		if err := result.Scan(&a.Name, &a.Type, &a.Value); err != nil {
+			return attributes, err
+		}
+
+		attributes = append(attributes, a)
+	}
+
+	return attributes, nil
+}
+
+// Builds a WHERE condition, against the user table aliased as u, matching
+// users whose attribute compares to the filter, e.g. "true", ">=3" or
+// "<2016-11-08". Users without the attribute only match "!=".
+func attributeCondition(name string, filter string) (string, []interface{}, error) {
+	attr := &Attribute{Name: name}
+	if err := attr.Load(); err != nil {
+		return "", nil, err
+	}
+
+	parts := attributeFilterPattern.FindStringSubmatch(strings.TrimSpace(filter))
+	op, value := parts[1], parts[2]
+	switch op {
+	case "":
+		op = "="
+	case "!":
+		op = "!="
+	}
+
+	value, err := attr.Normalize(value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if op != "=" && op != "!=" && attr.Type != AttributeNumber && attr.Type != AttributeDate {
+		return "", nil, errors.New(name + " can only be compared with = or !=.")
+	}
+
+	column := "a.value"
+	if attr.Type == AttributeNumber {
+		column = "CAST(a.value AS DECIMAL(20,6))"
+	}
+
+	exists := "EXISTS"
+	if op == "!=" {
+		exists = "NOT EXISTS"
+		op = "="
+	}
+
+	return exists + " (SELECT 1 FROM user_attribute AS a WHERE a.user_id = u.id AND a.name = ? AND " + column + " " + op + " ?)",
+		[]interface{}{attr.Name, value}, nil
+}
+
+// Same as attributeCondition, for a filter written as one expression like
+// "first_time_voter=true".
+func attributeExprCondition(expr string) (string, []interface{}, error) {
+	parts := attributeExprPattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(expr)))
+	if parts == nil {
+		return "", nil, errors.New("Attribute filters look like name=value or name>=value.")
+	}
+
+	return attributeCondition(parts[1], parts[2])
+}
+
+// Substitution variables for the user's message bodies: their fields, tags
+// and attributes, keyed by lowercase name.
+func (this *User) Variables() map[string]string {
+	if this.vars != nil {
+		return this.vars
+	}
+
+	vars := this.fieldVariables()
+
+	if tags, err := this.Tags(); err == nil {
+		vars["tags"] = strings.Join(tags, ", ")
+	}
+
+	if attributes, err := this.Attributes(); err == nil {
+		for _, a := range attributes {
+			vars[a.Name] = a.Value
+		}
+	}
+
+	return vars
+}
+
+func (this *User) fieldVariables() map[string]string {
+	vars := map[string]string{
+		"name":    this.Name,
+		"state":   this.State,
+		"zipcode": "",
+		"tags":    "",
+	}
+
+	if this.Zipcode != 0 {
+		vars["zipcode"] = strconv.Itoa(this.Zipcode)
+	}
+
+	return vars
+}
+
+// Loads Variables for a whole batch of users with one query for all their
+// tags and one for their attributes, instead of two for each user.
+func PreloadVariables(users []*User) error {
+	byID := map[int64][]*User{}
+	ids := []interface{}{}
+
+	for _, u := range users {
+		if u.ID == 0 {
+			continue
+		}
+
+		if _, ok := byID[u.ID]; !ok {
+			ids = append(ids, u.ID)
+		}
+
+		byID[u.ID] = append(byID[u.ID], u)
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	vars := map[int64]map[string]string{}
+	tags := map[int64][]string{}
+	for id, list := range byID {
+		vars[id] = list[0].fieldVariables()
+	}
+
+	in := "(?" + strings.Repeat(",?", len(ids)-1) + ")"
+	db := NewMySQL()
+
+	result, err := db.Select("SELECT user_id, tag FROM user_tag WHERE user_id IN "+in+" ORDER BY tag", ids...)
+	if err != nil {
+		return err
+	}
+
+	for result.Next() {
+		var id int64
+		var tag string
+		if err := result.Scan(&id, &tag); err != nil {
+			return err
+		}
+
+		tags[id] = append(tags[id], tag)
+	}
+
+	result, err = db.Select("SELECT user_id, name, value FROM user_attribute WHERE user_id IN "+in, ids...)
+	if err != nil {
+		return err
+	}
+
+	for result.Next() {
+		var id int64
+		var name, value string
+		if err := result.Scan(&id, &name, &value); err != nil {
+			return err
+		}
+
+		vars[id][name] = value
+	}
+
+	for id, list := range byID {
+		vars[id]["tags"] = strings.Join(tags[id], ", ")
+
+		for _, u := range list {
+			u.vars = vars[id]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Admin actions that need a paper trail, like sending through quiet hours.
+type AuditEntry struct {
+	ID        int64  `json:"id"`
+	Admin     string `json:"admin"`
+	Action    string `json:"action"`
+	Detail    string `json:"detail"`
+	IP        string `json:"ip"`
+	CreatedOn string `json:"created_on"`
+}
+
+func GetAuditLog(limit int64, offset int64) ([]*AuditEntry, error) {
+	db := NewMySQL()
+
+	result, err := db.Select(`SELECT id, admin, action, detail, ip, created_on
+		FROM audit_log ORDER BY id DESC LIMIT ?, ?`, offset, limit)
+	if err != nil {
+		return []*AuditEntry{}, err
+	}
+
+	entries := []*AuditEntry{}
+
+	for result.Next() {
+		e := &AuditEntry{}
+
+		if err := result.Scan(&e.ID, &e.Admin, &e.Action, &e.Detail, &e.IP, &e.CreatedOn); err != nil {
+			return entries, err
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// Records an action taken by the admin making the request.
+func RecordAudit(r *http.Request, action string, detail string) error {
+	admin, _, _ := r.BasicAuth()
+
+	db := NewMySQL()
+
+	_, err := db.Insert(
+		"INSERT INTO audit_log SET admin=?, action=?, detail=?, ip=?",
+		admin,
+		action,
+		detail,
+		requestIP(r),
+	)
+
+	return err
+}
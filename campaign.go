@@ -0,0 +1,406 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+)
+
+// A campaign sends one message to everyone in an audience. When started from
+// a segment the audience is a copy of its filters, so editing the segment
+// doesn't change who a running campaign reaches. Recipients are
+// added in batches by campaignService so large audiences don't tie up a
+// request, and a campaign can be paused or cancelled part way through.
+type Campaign struct {
+	ID        int64             `json:"id"`
+	Name      string            `json:"name"`
+	MessageID int64             `json:"message_id"`
+	SegmentID int64             `json:"segment_id"`
+	Audience  map[string]string `json:"audience"`
+	SendOn    string            `json:"send_on"`
+	QuietOK   int               `json:"quiet_ok"`
+	Status    string            `json:"status"`
+	CursorID  int64             `json:"cursor_id"`
+	Queued    int64             `json:"queued"`
+	CreatedBy string            `json:"created_by"`
+	CreatedOn string            `json:"created_on"`
+	Report    *CampaignReport   `json:"report"`
+}
+
+type CampaignReport struct {
+	Queued       int64 `json:"queued"`
+	Sent         int64 `json:"sent"`
+	Failed       int64 `json:"failed"`
+	Cancelled    int64 `json:"cancelled"`
+	Replied      int64 `json:"replied"`
+	Unsubscribed int64 `json:"unsubscribed"`
+}
+
+const (
+	CampaignRunning   = "running"
+	CampaignPaused    = "paused"
+	CampaignCancelled = "cancelled"
+	CampaignDone      = "done"
+)
+
+// Running campaigns can be paused or cancelled, paused ones resumed or
+// cancelled; done and cancelled are final.
+var campaignTransitions map[string][]string = map[string][]string{
+	CampaignRunning:   {CampaignPaused},
+	CampaignPaused:    {CampaignRunning},
+	CampaignCancelled: {CampaignRunning, CampaignPaused},
+	CampaignDone:      {CampaignRunning},
+}
+
+// Recipients added per batch.
+const campaignBatchSize = 500
+
+// How long a paused campaign's queued sends wait before checking again.
+const campaignHoldWait = time.Minute
+
+// Send on is a wall clock time, applied in each recipient's own zone.
+const campaignTimeFormat = "2006/01/02 15:04:05"
+
+func GetCampaigns(status string) ([]*Campaign, error) {
+	db := NewMySQL()
+
+	where := "1=1"
+	whereVars := []interface{}{}
+	if status != "" {
+		where = "status=?"
+		whereVars = append(whereVars, status)
+	}
+
+	result, err := db.Select(`SELECT id, name, message_id, IFNULL(segment_id, 0), audience, send_on, quiet_ok, status, cursor_id, queued, created_by, created_on
+		FROM campaign WHERE `+where+` ORDER BY id DESC`, whereVars...)
+	if err != nil {
+		return []*Campaign{}, err
+	}
+
+	campaigns := []*Campaign{}
+
+	for result.Next() {
+		c := &Campaign{}
+		audienceStr := ""
+
+		err := result.Scan(&c.ID, &c.Name, &c.MessageID, &c.SegmentID, &audienceStr, &c.SendOn, &c.QuietOK, &c.Status, &c.CursorID, &c.Queued, &c.CreatedBy, &c.CreatedOn)
+		if err != nil {
+			return campaigns, err
+		}
+
+		c.Audience = Mapify(audienceStr)
+		campaigns = append(campaigns, c)
+	}
+
+	return campaigns, nil
+}
+
+func (this *Campaign) Save() error {
+	if this.Name == "" || this.MessageID == 0 {
+		return errors.New("Missing required name and message fields.")
+	}
+
+	if this.SendOn != "" {
+		if _, err := time.Parse(campaignTimeFormat, this.SendOn); err != nil {
+			return errors.New("Invalid send on date.")
+		}
+	}
+
+	if err := ValidateAudience(this.Audience); err != nil {
+		return err
+	}
+
+	if this.Status == "" {
+		this.Status = CampaignRunning
+	}
+
+	db := NewMySQL()
+
+	var err error
+
+	if this.ID == 0 {
+		newID, err := db.Insert(
+			"INSERT INTO campaign SET name=?, message_id=?, segment_id=?, audience=?, send_on=?, quiet_ok=?, status=?, created_by=?",
+			this.Name,
+			this.MessageID,
+			SQLNullIfZero(this.SegmentID),
+			Stringify(this.Audience),
+			this.SendOn,
+			this.QuietOK,
+			this.Status,
+			this.CreatedBy,
+		)
+
+		if err == nil {
+			this.ID = newID
+		}
+	} else {
+		_, err = db.Update(
+			"UPDATE campaign SET name=?, message_id=?, segment_id=?, audience=?, send_on=?, quiet_ok=? WHERE id=?",
+			this.Name,
+			this.MessageID,
+			SQLNullIfZero(this.SegmentID),
+			Stringify(this.Audience),
+			this.SendOn,
+			this.QuietOK,
+			this.ID,
+		)
+	}
+
+	return err
+}
+
+func (this *Campaign) Load() error {
+	if this.ID == 0 {
+		return errors.New("Campaign missing required fields for load: id")
+	}
+
+	db := NewMySQL()
+
+	result, err := db.Select(`SELECT id, name, message_id, IFNULL(segment_id, 0), audience, send_on, quiet_ok, status, cursor_id, queued, created_by, created_on
+		FROM campaign WHERE id=? LIMIT 1`, this.ID)
+	if err != nil {
+		return err
+	}
+
+	for result.Next() {
+		audienceStr := ""
+
+		err = result.Scan(&this.ID, &this.Name, &this.MessageID, &this.SegmentID, &audienceStr, &this.SendOn, &this.QuietOK, &this.Status, &this.CursorID, &this.Queued, &this.CreatedBy, &this.CreatedOn)
+		if err != nil {
+			return err
+		}
+
+		this.Audience = Mapify(audienceStr)
+	}
+
+	if this.CreatedOn == "" {
+		return errors.New("Campaign not found.")
+	}
+
+	return nil
+}
+
+// Moves the campaign to a new status if allowed from its current one.
+func (this *Campaign) SetStatus(status string) (bool, error) {
+	from, ok := campaignTransitions[status]
+	if !ok {
+		return false, errors.New("Invalid campaign status: " + status)
+	}
+
+	db := NewMySQL()
+
+	params := []interface{}{status, this.ID}
+	for _, v := range from {
+		params = append(params, v)
+	}
+
+	changed, err := db.Update(
+		"UPDATE campaign SET status=? WHERE id=? AND status IN (?"+strings.Repeat(",?", len(from)-1)+")",
+		params...,
+	)
+	if err != nil || !changed {
+		return false, err
+	}
+
+	this.Status = status
+
+	// Anything still waiting on its send time, or in the outbound queue, is
+	// dropped.
+	if status == CampaignCancelled {
+		_, err = db.Update(
+			"UPDATE user_message SET status=?, status_detail=? WHERE campaign_id=? AND status=?",
+			DeliveryCancelled,
+			"Campaign cancelled.",
+			this.ID,
+			DeliveryQueued,
+		)
+
+		if err == nil {
+			err = CancelCampaignDeliveries(this.ID, "Campaign cancelled.")
+		}
+	}
+
+	return true, err
+}
+
+// The status of the campaign a user_message was sent for, or "" if it
+// wasn't part of one.
+func GetCampaignStatusForMessageTo(messageToID int64) (string, error) {
+	db := NewMySQL()
+
+	result, err := db.Select(`SELECT c.status FROM user_message AS um
+		JOIN campaign AS c ON (c.id = um.campaign_id)
+		WHERE um.id=? LIMIT 1`, messageToID)
+	if err != nil {
+		return "", err
+	}
+
+	status := ""
+	for result.Next() {
+		if err := result.Scan(&status); err != nil {
+			return "", err
+		}
+	}
+
+	return status, nil
+}
+
+// Adds the next batch of recipients and sends (or schedules) to them.
+// Returns false once the audience is exhausted.
+func (this *Campaign) FanOut() (bool, error) {
+	// Pick up a pause or cancel made since the last batch.
+	if err := this.Load(); err != nil {
+		return false, err
+	}
+
+	if this.Status != CampaignRunning {
+		return false, nil
+	}
+
+	msg := &Message{ID: this.MessageID}
+	if err := msg.Load(); err != nil {
+		return false, err
+	}
+
+	users, err := ListAudienceUsers(this.Audience, this.CursorID, campaignBatchSize)
+	if err != nil {
+		return false, err
+	}
+
+	if len(users) == 0 {
+		_, err := this.SetStatus(CampaignDone)
+		return false, err
+	}
+
+	var sendOnTime time.Time
+	if this.SendOn != "" {
+		sendOnTime, _ = time.Parse(campaignTimeFormat, this.SendOn)
+	}
+
+	msg.CampaignID = this.ID
+	msg.QuietOK = this.QuietOK
+
+	if err := PreloadVariables(users); err != nil {
+		log.Println(err.Error())
+	}
+
+	for _, user := range users {
+		msg.AddTo(user.UUID, user.Network, nil)
+
+		mt := msg.To[len(msg.To)-1]
+		mt.user = user
+
+		if !sendOnTime.IsZero() {
+			mt.SendOn = FormatDBTime(InLocation(sendOnTime, user.Location()))
+		}
+	}
+
+	sendErr := msg.Send()
+
+	// Move the cursor even if some sends failed, they're recorded as failed
+	// against the campaign rather than retried as new recipients. If we stop
+	// before the cursor moves the batch is run again, and the unique key on
+	// campaign_id, uuid and network keeps anyone from getting it twice.
+	this.CursorID = users[len(users)-1].ID
+	this.Queued += int64(len(users))
+
+	db := NewMySQL()
+	if _, err := db.Update("UPDATE campaign SET cursor_id=?, queued=? WHERE id=?", this.CursorID, this.Queued, this.ID); err != nil {
+		return false, err
+	}
+
+	if sendErr != nil {
+		log.Println(sendErr.Error())
+	}
+
+	return true, nil
+}
+
+func (this *Campaign) LoadReport() error {
+	db := NewMySQL()
+
+	report := &CampaignReport{}
+
+	result, err := db.Select("SELECT status, COUNT(*) FROM user_message WHERE campaign_id=? GROUP BY status", this.ID)
+	if err != nil {
+		return err
+	}
+
+	for result.Next() {
+		var status string
+		var count int64
+
+		if err := result.Scan(&status, &count); err != nil {
+			return err
+		}
+
+		switch status {
+		case DeliveryQueued, DeliverySending:
+			report.Queued += count
+		case DeliverySent, DeliveryDelivered:
+			report.Sent += count
+		case DeliveryFailed, DeliveryBounced:
+			report.Failed += count
+		case DeliveryCancelled:
+			report.Cancelled += count
+		}
+	}
+
+	// Recipients who texted back after the campaign reached them.
+	result, err = db.Select(`SELECT COUNT(DISTINCT um.uuid, um.network)
+		FROM user_message AS um
+		JOIN user_message AS r ON (r.uuid = um.uuid AND r.network = um.network AND r.status = ? AND r.id > um.id)
+		WHERE um.campaign_id=? AND um.sent=1`, DeliveryReceived, this.ID)
+	if err != nil {
+		return err
+	}
+
+	for result.Next() {
+		result.Scan(&report.Replied)
+	}
+
+	// And who opted out afterwards.
+	result, err = db.Select(`SELECT COUNT(DISTINCT um.uuid, um.network)
+		FROM user_message AS um
+		JOIN consent AS c ON (c.uuid = um.uuid AND c.network = um.network AND c.event = ? AND c.created_on >= um.created_on)
+		WHERE um.campaign_id=? AND um.sent=1`, ConsentOptOut, this.ID)
+	if err != nil {
+		return err
+	}
+
+	for result.Next() {
+		result.Scan(&report.Unsubscribed)
+	}
+
+	this.Report = report
+
+	return nil
+}
+
+func campaignService() {
+	for {
+		campaigns, err := GetCampaigns(CampaignRunning)
+		if err != nil {
+			log.Println(err.Error())
+		}
+
+		for _, c := range campaigns {
+			for {
+				more, err := c.FanOut()
+				if err != nil {
+					log.Println(err.Error())
+					break
+				}
+
+				if !more {
+					log.Printf("Campaign %d %s with %d recipients.\n", c.ID, c.Status, c.Queued)
+					break
+				}
+			}
+		}
+
+		time.Sleep(1000 * time.Millisecond * 15) // 15 seconds
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Consent events are append-only: rows are only ever inserted, never updated
+// or deleted, so the ledger can be handed over as-is for legal requests.
+type Consent struct {
+	ID           int64  `json:"id"`
+	UserID       int64  `json:"user_id"`
+	Network      string `json:"network"`
+	UUID         string `json:"uuid"`
+	Event        string `json:"event"`
+	Source       string `json:"source"`
+	IP           string `json:"ip"`
+	UserAgent    string `json:"user_agent"`
+	TermsVersion string `json:"terms_version"`
+	Detail       string `json:"detail"`
+	CreatedOn    string `json:"created_on"`
+}
+
+const (
+	ConsentOptIn       = "opt_in"
+	ConsentOptOut      = "opt_out"
+	ConsentConfirm     = "confirm"
+	ConsentResubscribe = "resubscribe"
+	ConsentExpire      = "expire"
+)
+
+const (
+	ConsentSourceWeb     = "web"
+	ConsentSourceKeyword = "keyword"
+	ConsentSourceAdmin   = "admin"
+	ConsentSourceLink    = "link"
+	ConsentSourceCarrier = "carrier"
+	ConsentSourceSystem  = "system"
+)
+
+func GetUserConsent(userID int64) ([]*Consent, error) {
+	db := NewMySQL()
+
+	result, err := db.Select(`SELECT id, user_id, network, uuid, event, source, ip, user_agent, terms_version, detail, created_on
+		FROM consent WHERE user_id=? ORDER BY id ASC`, userID)
+	if err != nil {
+		return []*Consent{}, err
+	}
+
+	ledger := []*Consent{}
+
+	for result.Next() {
+		c := &Consent{}
+
+		err := result.Scan(&c.ID, &c.UserID, &c.Network, &c.UUID, &c.Event, &c.Source, &c.IP, &c.UserAgent, &c.TermsVersion, &c.Detail, &c.CreatedOn)
+		if err != nil {
+			return ledger, err
+		}
+
+		ledger = append(ledger, c)
+	}
+
+	return ledger, nil
+}
+
+// A consent event, with the IP and user agent of the request that caused it
+// when there was one.
+func NewConsent(event string, source string, r *http.Request) *Consent {
+	c := &Consent{
+		Event:        event,
+		Source:       source,
+		TermsVersion: *TermsVersion,
+	}
+
+	if r != nil {
+		c.IP = requestIP(r)
+		c.UserAgent = r.UserAgent()
+	}
+
+	return c
+}
+
+func (this *Consent) Record(user *User) error {
+	if user.ID == 0 || this.Event == "" || this.Source == "" {
+		return errors.New("Consent record not complete enough to save.")
+	}
+
+	this.UserID = user.ID
+	this.Network = user.Network
+	this.UUID = user.UUID
+
+	this.UserAgent = Truncate(this.UserAgent, 255)
+	this.Detail = Truncate(this.Detail, 255)
+
+	db := NewMySQL()
+
+	newID, err := db.Insert(
+		"INSERT INTO consent SET user_id=?, network=?, uuid=?, event=?, source=?, ip=?, user_agent=?, terms_version=?, detail=?",
+		this.UserID,
+		this.Network,
+		this.UUID,
+		this.Event,
+		this.Source,
+		this.IP,
+		this.UserAgent,
+		this.TermsVersion,
+		this.Detail,
+	)
+	if err != nil {
+		return err
+	}
+
+	this.ID = newID
+
+	return nil
+}
+
+// The client address. Clients can send their own X-Forwarded-For, so it's
+// only used with -trust-proxy, and then only the last hop, the one our load
+// balancer added.
+func requestIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" && *TrustProxy {
+		hops := strings.Split(fwd, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
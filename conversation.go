@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+)
+
+// A user's two-way thread as seen from the admin inbox.
+type Conversation struct {
+	User          *User  `json:"user"`
+	Unread        int64  `json:"unread"`
+	LastMessage   string `json:"last_message"`
+	LastInboundOn string `json:"last_inbound_on"`
+	AssignedTo    string `json:"assigned_to"`
+}
+
+type ConversationFilter struct {
+	State      string
+	Landing    string
+	AssignedTo string
+	UnreadOnly bool
+}
+
+// Users who have replied, most recent reply first.
+func ListConversations(filter ConversationFilter, limit int64, offset int64) ([]*Conversation, error) {
+	db := NewMySQL()
+
+	var list []*Conversation
+
+	where := []string{"um.status = ?"}
+	whereVars := []interface{}{DeliveryReceived}
+
+	if filter.State != "" {
+		where = append(where, "u.state = ?")
+		whereVars = append(whereVars, filter.State)
+	}
+
+	if filter.Landing != "" {
+		where = append(where, "u.landing_page = ?")
+		whereVars = append(whereVars, filter.Landing)
+	}
+
+	if filter.AssignedTo != "" {
+		where = append(where, "c.assigned_to = ?")
+		whereVars = append(whereVars, filter.AssignedTo)
+	}
+
+	having := ""
+	if filter.UnreadOnly {
+		having = "HAVING unread > 0"
+	}
+
+	whereVars = append(whereVars, offset, limit)
+
+	result, err := db.Select(`SELECT
+		u.id, u.network, u.uuid, u.name, u.state, u.landing_page,
+		SUM(um.unread) AS unread, MAX(um.created_on) AS last_inbound_on,
+		(SELECT m.message FROM user_message AS lum JOIN message AS m ON (m.id = lum.message_id)
+			WHERE lum.uuid = u.uuid AND lum.network = u.network AND lum.status = um.status
+			ORDER BY lum.id DESC LIMIT 1) AS last_message,
+		IFNULL(c.assigned_to, '') AS assigned_to
+		FROM user_message AS um
+		JOIN user AS u ON (u.uuid = um.uuid AND u.network = um.network)
+		LEFT JOIN conversation AS c ON (c.user_id = u.id)
+		WHERE `+strings.Join(where, " AND ")+`
+		GROUP BY u.id `+having+`
+		ORDER BY last_inbound_on DESC LIMIT ?, ?`,
+		whereVars...)
+	if err != nil {
+		return list, err
+	}
+
+	for result.Next() {
+		c := &Conversation{User: &User{}}
+
+		err := result.Scan(&c.User.ID, &c.User.Network, &c.User.UUID, &c.User.Name, &c.User.State, &c.User.LandingPage, &c.Unread, &c.LastInboundOn, &c.LastMessage, &c.AssignedTo)
+		if err != nil {
+			return list, err
+		}
+
+		list = append(list, c)
+	}
+
+	return list, nil
+}
+
+func GetConversationAssignees() ([]string, error) {
+	db := NewMySQL()
+
+	assignees := []string{}
+
+	result, err := db.Select("SELECT DISTINCT assigned_to FROM conversation WHERE assigned_to != '' ORDER BY assigned_to")
+	if err != nil {
+		return assignees, err
+	}
+
+	for result.Next() {
+		var a string
+		if err := result.Scan(&a); err != nil {
+			return assignees, err
+		}
+
+		assignees = append(assignees, a)
+	}
+
+	return assignees, nil
+}
+
+func GetConversationAssignee(userID int64) (string, error) {
+	db := NewMySQL()
+
+	result, err := db.Select("SELECT assigned_to FROM conversation WHERE user_id=? LIMIT 1", userID)
+	if err != nil {
+		return "", err
+	}
+
+	assignee := ""
+	for result.Next() {
+		result.Scan(&assignee)
+	}
+
+	return assignee, nil
+}
+
+// Assigns the user's conversation to a volunteer, or unassigns it when who is empty.
+func AssignConversation(userID int64, who string) error {
+	db := NewMySQL()
+
+	_, err := db.Insert(
+		"INSERT INTO conversation SET user_id=?, assigned_to=? ON DUPLICATE KEY UPDATE assigned_to=VALUES(assigned_to)",
+		userID,
+		who,
+	)
+
+	return err
+}
+
+func MarkConversationRead(uuid string, network string) error {
+	db := NewMySQL()
+
+	_, err := db.Update("UPDATE user_message SET unread=0 WHERE uuid=? AND network=? AND unread=1", uuid, network)
+
+	return err
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const electionDateFormat = "2006-01-02"
+
+// Election calendar events reminders can be attached to.
+var electionEvents map[string]bool = map[string]bool{
+	"election_date":             true,
+	"registration_deadline":     true,
+	"early_voting_start":        true,
+	"early_voting_end":          true,
+	"absentee_request_deadline": true,
+}
+
+type Election struct {
+	State                   string
+	Type                    string
+	Date                    time.Time
+	RegistrationDeadline    time.Time
+	EarlyVotingStart        time.Time
+	EarlyVotingEnd          time.Time
+	AbsenteeRequestDeadline time.Time
+}
+
+// Stable identifier for the election, used to remember which reminders have
+// already been scheduled.
+func (this *Election) Key() string {
+	return fmt.Sprintf("%s-%s-%s", this.State, this.Date.Format(electionDateFormat), this.Type)
+}
+
+func (this *Election) EventDate(event string) time.Time {
+	switch event {
+	case "election_date":
+		return this.Date
+	case "registration_deadline":
+		return this.RegistrationDeadline
+	case "early_voting_start":
+		return this.EarlyVotingStart
+	case "early_voting_end":
+		return this.EarlyVotingEnd
+	case "absentee_request_deadline":
+		return this.AbsenteeRequestDeadline
+	}
+
+	return time.Time{}
+}
+
+type ReminderRule struct {
+	Event      string
+	OffsetDays int
+	Slug       string
+}
+
+type ElectionCalendar struct {
+	Version   string
+	Elections []*Election
+	Rules     []*ReminderRule
+}
+
+var calendarMutex sync.RWMutex
+var calendar *ElectionCalendar = &ElectionCalendar{}
+
+func GetCalendar() *ElectionCalendar {
+	calendarMutex.RLock()
+	defer calendarMutex.RUnlock()
+
+	return calendar
+}
+
+// Loads the election and reminder rule files. Both are CSV with a header row;
+// lines starting with # are comments and a leading "# version: x" line names
+// the calendar version.
+func LoadCalendar(electionsPath string, rulesPath string) error {
+	cal := &ElectionCalendar{}
+
+	version, rows, err := readCalendarCSV(electionsPath)
+	if err != nil {
+		return err
+	}
+
+	cal.Version = version
+
+	for i, row := range rows {
+		election, err := parseElection(row)
+		if err != nil {
+			return fmt.Errorf("%s line %d: %s", electionsPath, i+2, err.Error())
+		}
+
+		cal.Elections = append(cal.Elections, election)
+	}
+
+	_, rows, err = readCalendarCSV(rulesPath)
+	if err != nil {
+		return err
+	}
+
+	for i, row := range rows {
+		if len(row) < 3 {
+			return fmt.Errorf("%s line %d: expected event, offset_days, slug", rulesPath, i+2)
+		}
+
+		if !electionEvents[row[0]] {
+			return fmt.Errorf("%s line %d: unknown event %s", rulesPath, i+2, row[0])
+		}
+
+		offset, err := strconv.Atoi(row[1])
+		if err != nil {
+			return fmt.Errorf("%s line %d: invalid offset %s", rulesPath, i+2, row[1])
+		}
+
+		cal.Rules = append(cal.Rules, &ReminderRule{Event: row[0], OffsetDays: offset, Slug: row[2]})
+	}
+
+	calendarMutex.Lock()
+	calendar = cal
+	calendarMutex.Unlock()
+
+	log.Printf("Loaded election calendar %s: %d elections, %d reminder rules.\n", cal.Version, len(cal.Elections), len(cal.Rules))
+
+	return nil
+}
+
+func readCalendarCSV(path string) (string, [][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+
+	version := ""
+	if line, err := br.Peek(10); err == nil && strings.HasPrefix(string(line), "# version:") {
+		first, _ := br.ReadString('\n')
+		version = strings.TrimSpace(strings.TrimPrefix(first, "# version:"))
+	}
+
+	r := csv.NewReader(br)
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	rows := [][]string{}
+	header := true
+
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return version, rows, err
+		}
+
+		if header {
+			header = false
+			continue
+		}
+
+		rows = append(rows, row)
+	}
+
+	return version, rows, nil
+}
+
+// state, type, election_date, registration_deadline, early_voting_start,
+// early_voting_end, absentee_request_deadline. Only the first three are required.
+func parseElection(row []string) (*Election, error) {
+	if len(row) < 3 {
+		return nil, errors.New("expected at least state, type and election_date")
+	}
+
+	for len(row) < 7 {
+		row = append(row, "")
+	}
+
+	dates := make([]time.Time, 5)
+	for i, v := range row[2:7] {
+		if v == "" {
+			continue
+		}
+
+		d, err := time.Parse(electionDateFormat, v)
+		if err != nil {
+			return nil, errors.New("invalid date " + v)
+		}
+
+		dates[i] = d
+	}
+
+	if dates[0].IsZero() {
+		return nil, errors.New("missing election_date")
+	}
+
+	return &Election{
+		State:                   strings.ToUpper(row[0]),
+		Type:                    row[1],
+		Date:                    dates[0],
+		RegistrationDeadline:    dates[1],
+		EarlyVotingStart:        dates[2],
+		EarlyVotingEnd:          dates[3],
+		AbsenteeRequestDeadline: dates[4],
+	}, nil
+}
+
+func (this *ElectionCalendar) UpcomingForState(state string, now time.Time) []*Election {
+	elections := []*Election{}
+
+	for _, e := range this.Elections {
+		if e.State == state && !e.Date.AddDate(0, 0, 1).Before(now) {
+			elections = append(elections, e)
+		}
+	}
+
+	return elections
+}
+
+func (this *ElectionCalendar) UpcomingStates(now time.Time) []string {
+	seen := map[string]bool{}
+	states := []string{}
+
+	for _, e := range this.Elections {
+		if !seen[e.State] && !e.Date.AddDate(0, 0, 1).Before(now) {
+			seen[e.State] = true
+			states = append(states, e.State)
+		}
+	}
+
+	return states
+}
+
+// Schedules every future reminder for the user's state that hasn't been
+// scheduled yet. Each reminder goes out at the start of the user's message
+// window on the day, in their time zone.
+func ScheduleElectionReminders(user *User) error {
+	if user.Deleted == 1 || user.Status != UserActive || user.Reminders != 1 {
+		return nil
+	}
+
+	cal := GetCalendar()
+	now := time.Now()
+	db := NewMySQL()
+
+	var errs []string
+
+	for _, election := range cal.UpcomingForState(user.State, now) {
+		for _, rule := range cal.Rules {
+			day := election.EventDate(rule.Event)
+			if day.IsZero() {
+				continue
+			}
+
+			day = day.AddDate(0, 0, rule.OffsetDays)
+			sendOn := user.NextSendTime(InLocation(day, user.Location()))
+			if sendOn.Before(now) {
+				continue
+			}
+
+			msg := &Message{Slug: rule.Slug}
+			if err := msg.Load(); err != nil || msg.ID == 0 {
+				continue
+			}
+
+			// Claim the reminder first so a concurrent run can't schedule it twice.
+			claimID, err := db.Insert(
+				"INSERT IGNORE INTO election_reminder SET election=?, slug=?, user_id=?",
+				election.Key(),
+				rule.Slug,
+				user.ID,
+			)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+
+			if claimID == 0 {
+				continue
+			}
+
+			msg.SendOn = FormatDBTime(sendOn)
+			msg.AddTo(user.UUID, user.Network, nil)
+
+			if err := msg.To[0].Save(); err != nil {
+				errs = append(errs, err.Error())
+
+				// Let the next run try again.
+				if _, err := db.Update("DELETE FROM election_reminder WHERE id=?", claimID); err != nil {
+					errs = append(errs, err.Error())
+				}
+
+				continue
+			}
+
+			db.Update("UPDATE election_reminder SET user_message_id=? WHERE id=?", msg.To[0].ID, claimID)
+		}
+	}
+
+	if errs != nil {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+func electionService() {
+	for {
+		if err := LoadCalendar(*ElectionsFile, *RemindersFile); err != nil {
+			log.Println(err.Error())
+		}
+
+		for _, rule := range GetCalendar().Rules {
+			msg := &Message{Slug: rule.Slug}
+			if err := msg.Load(); err != nil || msg.ID == 0 {
+				log.Printf("Reminder message %s does not exist, skipping it.\n", rule.Slug)
+			}
+		}
+
+		for _, state := range GetCalendar().UpcomingStates(time.Now()) {
+			var afterID int64
+
+			for {
+				users, err := ListReminderUsers(state, afterID, 500)
+				if err != nil {
+					log.Println(err.Error())
+					break
+				}
+
+				if len(users) == 0 {
+					break
+				}
+
+				for _, user := range users {
+					if err := ScheduleElectionReminders(user); err != nil {
+						log.Println(err.Error())
+					}
+
+					afterID = user.ID
+				}
+			}
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
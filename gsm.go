@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// Texts are sent as GSM-7 when every character is in the GSM 03.38 alphabet,
+// otherwise as UCS-2, which fits less than half as much in each segment.
+const (
+	EncodingGSM7 = "GSM-7"
+	EncodingUCS2 = "UCS-2"
+)
+
+const gsm7Basic = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+
+// Extension characters take two septets, an escape and the character.
+const gsm7Extended = "\f^{}\\[~]|€"
+
+type SMSLength struct {
+	Encoding string   `json:"encoding"`
+	Chars    int      `json:"chars"`
+	Segments int      `json:"segments"`
+	Unicode  []string `json:"unicode"`
+}
+
+// Works out how a body will be encoded and how many segments it takes. Chars
+// is in the encoding's units: septets for GSM-7, UTF-16 code units for UCS-2.
+func MeasureSMS(body string) *SMSLength {
+	length := &SMSLength{Encoding: EncodingGSM7, Unicode: []string{}}
+
+	seen := map[rune]bool{}
+	for _, r := range body {
+		switch {
+		case strings.ContainsRune(gsm7Basic, r):
+			length.Chars++
+		case strings.ContainsRune(gsm7Extended, r):
+			length.Chars += 2
+		default:
+			length.Encoding = EncodingUCS2
+			if !seen[r] {
+				seen[r] = true
+				length.Unicode = append(length.Unicode, string(r))
+			}
+		}
+	}
+
+	single, multi := 160, 153
+	if length.Encoding == EncodingUCS2 {
+		length.Chars = len(utf16.Encode([]rune(body)))
+		single, multi = 70, 67
+	}
+
+	switch {
+	case length.Chars == 0:
+		length.Segments = 0
+	case length.Chars <= single:
+		length.Segments = 1
+	default:
+		length.Segments = (length.Chars + multi - 1) / multi
+	}
+
+	return length
+}
+
+// Typographic characters word processors and phones like to insert, and the
+// GSM-7 characters they can be swapped for.
+var smartChars = strings.NewReplacer(
+	"‘", "'", "’", "'", "‚", "'", "‛", "'", "′", "'",
+	"“", "\"", "”", "\"", "„", "\"", "‟", "\"", "″", "\"", "«", "\"", "»", "\"",
+	"–", "-", "—", "-", "―", "-", "‐", "-", "‑", "-", "−", "-",
+	"…", "...",
+	"•", "-",
+	"\u00a0", " ", "\u2002", " ", "\u2003", " ", "\u2009", " ", "\u202f", " ",
+	"\u200b", "", "\u200c", "", "\u200d", "", "\ufeff", "",
+	"\t", " ",
+)
+
+func NormalizeSmartChars(body string) string {
+	return smartChars.Replace(body)
+}
+
+// The message's length as sent to the sample recipient.
+func (this *Message) Length() *SMSLength {
+	body, err := sampleMessageContext().Render(this.Message)
+	if err != nil {
+		body = this.Message
+	}
+
+	if *NormalizeChars {
+		body = NormalizeSmartChars(body)
+	}
+
+	return MeasureSMS(body)
+}
+
+// Checks an outgoing message against the -max-segments policy, measured as
+// rendered for the sample recipient.
+func CheckSegmentPolicy(body string) error {
+	if *MaxSegments <= 0 {
+		return nil
+	}
+
+	length := (&Message{Message: body}).Length()
+	if length.Segments > *MaxSegments {
+		detail := ""
+		if length.Encoding == EncodingUCS2 {
+			detail = fmt.Sprintf(" It's sent as %s because of %s.", EncodingUCS2, strings.Join(length.Unicode, " "))
+		}
+
+		return fmt.Errorf("Message is %d segments, the most allowed is %d.%s", length.Segments, *MaxSegments, detail)
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMeasureSMS(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		encoding string
+		chars    int
+		segments int
+		unicode  []string
+	}{
+		{"empty", "", EncodingGSM7, 0, 0, []string{}},
+		{"plain", "Hello", EncodingGSM7, 5, 1, []string{}},
+		{"extended", "€5 {ok}", EncodingGSM7, 10, 1, []string{}},
+		{"gsm single limit", strings.Repeat("a", 160), EncodingGSM7, 160, 1, []string{}},
+		{"gsm over single", strings.Repeat("a", 161), EncodingGSM7, 161, 2, []string{}},
+		{"gsm extended over single", strings.Repeat("a", 159) + "€", EncodingGSM7, 161, 2, []string{}},
+		{"ucs2", "Hi ą", EncodingUCS2, 4, 1, []string{"ą"}},
+		{"ucs2 surrogate pair", "Hi 😀", EncodingUCS2, 5, 1, []string{"😀"}},
+		{"ucs2 repeated", "😀😀ą", EncodingUCS2, 5, 1, []string{"😀", "ą"}},
+		{"ucs2 extended", "€ą", EncodingUCS2, 2, 1, []string{"ą"}},
+		{"ucs2 single limit", strings.Repeat("ą", 70), EncodingUCS2, 70, 1, []string{"ą"}},
+		{"ucs2 over single", strings.Repeat("ą", 71), EncodingUCS2, 71, 2, []string{"ą"}},
+		{"ucs2 surrogate pairs over single", strings.Repeat("😀", 36), EncodingUCS2, 72, 2, []string{"😀"}},
+	}
+
+	for _, tt := range tests {
+		got := MeasureSMS(tt.body)
+
+		if got.Encoding != tt.encoding || got.Chars != tt.chars || got.Segments != tt.segments {
+			t.Errorf("%s: got %s %d chars %d segments, want %s %d chars %d segments",
+				tt.name, got.Encoding, got.Chars, got.Segments, tt.encoding, tt.chars, tt.segments)
+		}
+
+		if !reflect.DeepEqual(got.Unicode, tt.unicode) {
+			t.Errorf("%s: got unicode %q, want %q", tt.name, got.Unicode, tt.unicode)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"unicode"
+)
+
+// Standard SMS program keywords, matched against the first word of a reply.
+var inboundKeywords map[string]string = map[string]string{
+	"STOP":        "stop",
+	"STOPALL":     "stop",
+	"UNSUBSCRIBE": "stop",
+	"CANCEL":      "stop",
+	"END":         "stop",
+	"QUIT":        "stop",
+	"START":       "start",
+	"UNSTOP":      "start",
+	"SUBSCRIBE":   "start",
+	"HELP":        "help",
+	"INFO":        "help",
+	"YES":         "confirm",
+	"Y":           "confirm",
+}
+
+// Saves an inbound message against the sender and runs keyword processing.
+func SaveInbound(in *InboundMessage) error {
+	sender := ResolveSender(in.From)
+	uuid, network := sender.UUID, sender.Network
+
+	if sender.User == nil {
+		log.Printf("Inbound message from unknown sender %s.\n", in.From)
+	}
+
+	body := in.Body
+	if body == "" && len(in.Attachments) > 0 {
+		body = "[attachment]"
+	}
+
+	msg := &Message{
+		To: []*MessageTo{
+			{UUID: uuid, Network: network, Status: DeliveryReceived},
+		},
+		Message:  body,
+		Outgoing: 0,
+		Slug:     MakeSlug("incoming_" + uuid + "@" + network),
+	}
+
+	if err := msg.Save(); err != nil {
+		return err
+	}
+
+	for _, a := range in.Attachments {
+		a.UserMessageID = msg.To[0].ID
+		if err := a.Save(); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	if err := ProcessInbound(msg.To[0], msg.Message); err != nil {
+		log.Println(err.Error())
+	}
+
+	return nil
+}
+
+func InboundKeyword(body string) string {
+	fields := strings.FieldsFunc(strings.ToUpper(body), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+
+	if len(fields) == 0 {
+		return ""
+	}
+
+	return inboundKeywords[fields[0]]
+}
+
+// Acts on a saved inbound message: keywords update the subscription and get a
+// confirmation reply, replies matching an auto-responder rule get its canned
+// answer, and anything else is flagged for an admin to follow up.
+func ProcessInbound(in *MessageTo, body string) error {
+	keyword := InboundKeyword(body)
+
+	user := &User{UUID: in.UUID, Network: in.Network}
+	loadErr := user.Load()
+	known := user.ID != 0
+
+	switch {
+	case keyword == "stop" && known:
+		if loadErr == nil {
+			consent := NewConsent(ConsentOptOut, ConsentSourceKeyword, nil)
+			consent.Detail = body
+
+			if err := user.Unsubscribe(consent); err != nil {
+				return err
+			}
+		}
+
+		return replyWithSlug(*StopSlug, in)
+	case keyword == "start" && known:
+		if user.Deleted == 1 {
+			consent := NewConsent(ConsentResubscribe, ConsentSourceKeyword, nil)
+			consent.Detail = body
+
+			if err := user.Resubscribe(consent); err != nil {
+				return err
+			}
+		}
+
+		return replyWithSlug(*StartSlug, in)
+	case keyword == "help":
+		return replyWithSlug(*HelpSlug, in)
+	case keyword == "confirm" && known && user.Status == UserPending:
+		consent := NewConsent(ConsentConfirm, ConsentSourceKeyword, nil)
+		consent.Detail = body
+
+		return ConfirmOptIn(user, consent)
+	}
+
+	// Unsubscribed users don't get auto-replies, only their STOP confirmed.
+	if loadErr == nil {
+		rules, err := GetResponderRules(true)
+		if err != nil {
+			log.Println(err.Error())
+		} else if rule := MatchResponderRule(rules, body, user.State); rule != nil {
+			return rule.Apply(in, user)
+		}
+	}
+
+	return in.Flag()
+}
+
+func replyWithSlug(slug string, to *MessageTo) error {
+	msg := &Message{Slug: slug}
+	if err := msg.Load(); err != nil {
+		return err
+	}
+
+	if msg.ID == 0 {
+		return errors.New("Reply message does not exist: " + slug)
+	}
+
+	// The user just texted us, so answering isn't held for quiet hours, and
+	// goes out even if what they texted was STOP.
+	msg.QuietOK = 1
+	msg.AddTo(to.UUID, to.Network, nil)
+	msg.To[0].Reply = true
+
+	if err := msg.Send(); err != nil {
+		return err
+	}
+
+	log.Printf("Sent %s reply to %s@%s.\n", slug, to.UUID, to.Network)
+
+	return nil
+}
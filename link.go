@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/hmac"
 	"crypto/sha1"
 	"database/sql"
 	"errors"
@@ -94,6 +95,44 @@ func (this *Link) Load() error {
 	return nil
 }
 
+// The user's standing unsubscribe link, for message bodies. Its hash is an
+// HMAC of the user's id under LINK_SECRET, so every message shares the one
+// link and nobody can work it out from an id. Nothing is saved, messages
+// that go out with it call Refresh.
+func UnsubscribeLink(user *User) (*Link, error) {
+	secret := os.Getenv("LINK_SECRET")
+	if secret == "" {
+		return nil, errors.New("LINK_SECRET must be set to send unsubscribe links.")
+	}
+
+	if user.ID == 0 {
+		return nil, errors.New("User must be saved before it can have an unsubscribe link.")
+	}
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	fmt.Fprintf(mac, "unsubscribe:%d", user.ID)
+
+	return &Link{
+		Hash:   fmt.Sprintf("%x", mac.Sum(nil)),
+		UserID: user.ID,
+		Action: "unsubscribe",
+	}, nil
+}
+
+// Saves a standing link, or brings back one that was used and expired.
+func (this *Link) Refresh() error {
+	db := NewMySQL()
+
+	_, err := db.Insert(
+		"INSERT INTO link SET hash=?, user_id=?, action=?, payload='' ON DUPLICATE KEY UPDATE expires_in=NULL",
+		this.Hash,
+		this.UserID,
+		this.Action,
+	)
+
+	return err
+}
+
 func (this *Link) Click() error {
 	db := NewMySQL()
 
@@ -122,10 +161,9 @@ func (this *Link) IsExpired() (bool, error) {
 	}
 
 	if this.ExpiresIn != 0 {
-		loc, _ := time.LoadLocation("Local")
-		createdOn, _ := time.ParseInLocation("2006-01-02 15:04:05", this.CreatedOn, loc)
+		createdOn, _ := ParseDBTime(this.CreatedOn)
 
-		if time.Now().Local().Unix() > createdOn.Unix()+this.ExpiresIn {
+		if time.Now().Unix() > createdOn.Unix()+this.ExpiresIn {
 			return true, nil
 		}
 	}
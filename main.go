@@ -8,6 +8,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/goji/httpauth"
@@ -17,6 +19,31 @@ import (
 // CLI Params
 var Port = flag.String("port", "8080", "Port for web server to run.")
 var WebRoot = flag.String("root", "./webroot/", "The web file root directory.")
+var DefaultTransport = flag.String("transport", "ses", "Outbound transport: ses, smtp or gmail.")
+var NetworkTransports = flag.String("network-transports", "", "Per-network transport overrides, e.g. verizon=smtp&att=ses")
+var SendWorkers = flag.Int("send-workers", 2, "Number of outbound queue workers.")
+var SendMaxAttempts = flag.Int("send-max-attempts", 5, "Send attempts before a message is dead-lettered.")
+var DefaultSendRate = flag.Float64("send-rate", 5, "Default sends per second for each transport.")
+var ElectionsFile = flag.String("elections", "./data/elections.csv", "Election calendar CSV file.")
+var RemindersFile = flag.String("reminders", "./data/reminders.csv", "Election reminder rules CSV file.")
+var ZipTimezonesFile = flag.String("zip-timezones", "./data/zip_timezones.csv", "Zipcode to time zone CSV file.")
+var HelpSlug = flag.String("help-slug", "help", "Message sent in reply to HELP or INFO.")
+var StopSlug = flag.String("stop-slug", "stop", "Message sent to confirm a STOP.")
+var StartSlug = flag.String("start-slug", "start", "Message sent to confirm a START.")
+var InboundSourceName = flag.String("inbound", "s3", "Inbound message source: s3, maildir or webhook.")
+var InboundBucket = flag.String("inbound-bucket", "iwillvote-sms", "S3 bucket SES writes inbound email to.")
+var InboundMaildir = flag.String("maildir", "./maildir", "Maildir directory for the maildir inbound source.")
+var AttachmentDir = flag.String("attachments", "./attachments", "Directory inbound attachments are stored in.")
+var ConfirmSlug = flag.String("confirm-slug", "confirm", "Message asking new signups to confirm, with a [[HASH]] link code.")
+var ConfirmExpiry = flag.Duration("confirm-expiry", 48*time.Hour, "How long a new signup has to confirm before it expires.")
+var QuietHours = flag.String("quiet-hours", "21-8", "Recipient local hours, start-end, when nothing but replies is sent. Empty to disable.")
+var TermsVersion = flag.String("terms-version", "2016-06-01", "Version of the signup terms currently shown, recorded with consent.")
+var TrustProxy = flag.Bool("trust-proxy", false, "Running behind a load balancer, take client addresses from the X-Forwarded-For it adds.")
+var BaseURL = flag.String("base-url", "http://iwillvote.us", "Public address of the site, used for links in messages.")
+var MaxSegments = flag.Int("max-segments", 3, "Most SMS segments an outgoing message may take, 0 for no limit.")
+var NormalizeChars = flag.Bool("normalize-chars", false, "Replace curly quotes, dashes and other smart characters so messages stay GSM-7.")
+var TestNumberList = flag.String("test-numbers", "", "Staff phones admins can send test messages to, e.g. 5555555555@sms,5555555556@verizon")
+var RateLimits = flag.String("rate-limits", "", "Sends per second by transport or carrier domain, e.g. ses=14&vtext.com=0.5:2")
 
 // Templates
 var Templates *template.Template
@@ -38,6 +65,23 @@ var Candidates map[string]bool = map[string]bool{
 func main() {
 	flag.Parse()
 
+	if err := loadRateLimiters(); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if err := loadNetworkTransports(); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if err := loadQuietHours(); err != nil {
+		log.Fatal(err.Error())
+	}
+
+	// Without the table users get their state's time zone.
+	if err := LoadZipTimezones(*ZipTimezonesFile); err != nil {
+		log.Println(err.Error())
+	}
+
 	// Load Templates
 	Templates = template.Must(template.ParseGlob(*WebRoot + "/templates/*"))
 
@@ -46,6 +90,9 @@ func main() {
 	// Start message services...
 	go sendService()
 	go receiveService()
+	go electionService()
+	go optInService()
+	go campaignService()
 
 	// Start web server...
 	r := mux.NewRouter()
@@ -56,13 +103,31 @@ func main() {
 	// API Endpoints
 	r.HandleFunc("/api/user/add/", addUserHandler).Methods("POST")
 	//r.HandleFunc("/api/user/remove/", removeUserHandler).Methods("POST")
+	r.HandleFunc("/api/webhook/ses/", sesWebhookHandler).Methods("POST")
+	r.HandleFunc("/api/webhook/sms/status/", smsStatusWebhookHandler).Methods("POST")
+	r.HandleFunc("/api/webhook/inbound/ses/", sesInboundWebhookHandler).Methods("POST")
+	r.HandleFunc("/api/webhook/inbound/sms/", smsInboundWebhookHandler).Methods("POST")
 
 	// Admin Endpoints
 	ar := mux.NewRouter().PathPrefix("/admin").Subrouter()
 	ar.HandleFunc("/", AdminIndexHandler)
 	ar.HandleFunc("/messages", AdminMessagesHandler).Methods("POST", "GET")
+	ar.HandleFunc("/messages/length", AdminMessageLengthHandler).Methods("POST")
+	ar.HandleFunc("/messages/{id:[0-9]+}/preview", AdminMessagePreviewHandler).Methods("POST", "GET")
+	ar.HandleFunc("/messages/{id:[0-9]+}/history", AdminMessageHistoryHandler)
 	ar.HandleFunc("/users", AdminUsersHandler)
 	ar.HandleFunc("/users/{user:[\\w]+@[\\w]+}", AdminUserDetailHandler)
+	ar.HandleFunc("/users/{user:[\\w]+@[\\w]+}/consent.csv", AdminConsentExportHandler)
+	ar.HandleFunc("/users/{user:[\\w]+@[\\w]+}/thread.csv", AdminThreadExportHandler)
+	ar.HandleFunc("/inbox", AdminInboxHandler).Methods("POST", "GET")
+	ar.HandleFunc("/rules", AdminRulesHandler).Methods("POST", "GET")
+	ar.HandleFunc("/campaigns", AdminCampaignsHandler).Methods("POST", "GET")
+	ar.HandleFunc("/segments", AdminSegmentsHandler).Methods("POST", "GET")
+	ar.HandleFunc("/segments/{id:[0-9]+}/export.csv", AdminSegmentExportHandler)
+	ar.HandleFunc("/audit", AdminAuditHandler)
+	ar.HandleFunc("/outbound", AdminOutboundHandler).Methods("POST", "GET")
+	ar.HandleFunc("/unknown", AdminUnknownInboundHandler)
+	ar.HandleFunc("/attachments/{path:[0-9a-f]{40}(?:\\.[a-z0-9]+)?}", AdminAttachmentHandler)
 	r.PathPrefix("/admin").Handler(httpauth.SimpleBasicAuth(os.Getenv("ADMIN_USER"), os.Getenv("ADMIN_PASS"))(ar))
 
 	// Pages
@@ -111,7 +176,7 @@ func pageHandler(w http.ResponseWriter, r *http.Request) {
 
 func codeHandler(w http.ResponseWriter, r *http.Request) {
 	var err error
-	var message, errorText string
+	var message, errorText, confirm string
 
 	params := mux.Vars(r)
 
@@ -133,12 +198,36 @@ func codeHandler(w http.ResponseWriter, r *http.Request) {
 	case "unsubscribe":
 		user := &User{ID: link.UserID}
 		if err = user.Load(); err == nil {
-			if err = user.Unsubscribe(); err == nil {
+			// Link previews fetch the page, so it takes pressing the button.
+			if r.Method != "POST" {
+				confirm = link.Action
+			} else if err = user.Unsubscribe(NewConsent(ConsentOptOut, ConsentSourceLink, r)); err == nil {
 				message = "You have successfully been unsubscribed! Please remember to vote a different way."
 
 				link.Expire()
 			}
 		}
+	case "confirm":
+		user := &User{ID: link.UserID}
+		if err = user.Load(); err == nil {
+			if user.Status != UserPending {
+				message = "You're already confirmed. Thanks for signing up!"
+
+				link.Expire()
+			} else if r.Method != "POST" {
+				// As with unsubscribing, a link preview mustn't do it for them.
+				confirm = link.Action
+			} else if err = ConfirmOptIn(user, NewConsent(ConsentConfirm, ConsentSourceLink, r)); err == nil {
+				message = "Thanks for confirming! We'll text you before every election."
+
+				link.Expire()
+			}
+		}
+
+		if err != nil {
+			log.Println(err.Error())
+			errorText = "We couldn't confirm your signup at this time. Please try again in a moment."
+		}
 	}
 
 	data := struct {
@@ -148,6 +237,7 @@ func codeHandler(w http.ResponseWriter, r *http.Request) {
 		CandidateList map[string]bool
 		Message       string
 		Error         string
+		Confirm       string
 	}{
 		Title:         "i Will Vote",
 		Active:        "",
@@ -155,6 +245,7 @@ func codeHandler(w http.ResponseWriter, r *http.Request) {
 		CandidateList: Candidates,
 		Message:       message,
 		Error:         errorText,
+		Confirm:       confirm,
 	}
 
 	err = Templates.ExecuteTemplate(w, "code", data)
@@ -189,6 +280,7 @@ func unsubHandler(w http.ResponseWriter, r *http.Request) {
 				if err = link.Save(); err == nil {
 					msg := &Message{Slug: "unsub"}
 					if err = msg.Load(); err == nil {
+						msg.QuietOK = 1
 						msg.AddTo(user.UUID, user.Network, map[string]string{"hash": link.Hash})
 
 						if err = msg.Send(); err == nil {
@@ -247,8 +339,7 @@ func removeUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	err = user.Load()
 	if user.ID != 0 {
-		user.Deleted = 1
-		if err = user.Save(); err != nil {
+		if err = user.Unsubscribe(NewConsent(ConsentOptOut, ConsentSourceWeb, r)); err != nil {
 			log.Println(err.Error())
 			jsonBytes, _ = json.Marshal(webError{Error: "Unable to update user."})
 		} else {
@@ -268,13 +359,24 @@ func addUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	r.ParseForm()
 
+	// Carrier is optional now that we can text directly.
+	network := r.FormValue("network")
+	if network == "" {
+		network = "sms"
+	}
+
 	user := &User{
-		Network:       r.FormValue("network"),
+		Network:       network,
 		UUID:          r.FormValue("uuid"),
 		Name:          r.FormValue("name"),
 		State:         r.FormValue("state"),
 		MessageWindow: r.FormValue("window"),
 		LandingPage:   r.FormValue("landing_page"),
+		Reminders:     1,
+	}
+
+	if zip, err := strconv.Atoi(r.FormValue("zipcode")); err == nil {
+		user.Zipcode = zip
 	}
 
 	if err = user.IsComplete(); err != nil {
@@ -282,21 +384,44 @@ func addUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	err = user.Load()
-	if user.ID == 0 {
+
+	// Someone who let an earlier signup expire can sign up again.
+	if user.ID != 0 && user.Status == UserExpired {
+		user.Name = r.FormValue("name")
+		user.State = r.FormValue("state")
+		user.MessageWindow = r.FormValue("window")
+		user.LandingPage = r.FormValue("landing_page")
+		user.Timezone = ""
+		user.Deleted = 0
+		user.Reminders = 1
+
+		if zip, err := strconv.Atoi(r.FormValue("zipcode")); err == nil {
+			user.Zipcode = zip
+		}
+	}
+
+	if user.ID == 0 || user.Status == UserExpired {
+		// New users are pending until they confirm.
+		user.Status = UserPending
+
+		consent := NewConsent(ConsentOptIn, ConsentSourceWeb, r)
+		consent.Detail = "landing_page=" + user.LandingPage
+
 		if err = user.Save(); err == nil {
-			message := &Message{Slug: "welcome"}
-			if err = message.Load(); err == nil {
-				message.AddTo(user.UUID, user.Network, nil)
+			err = consent.Record(user)
+		}
 
-				if err = message.Send(); err == nil {
-					jsonBytes, _ = json.Marshal(webUserResponse{Data: []*User{user}, Status: "User created and welcome message sent."})
-				}
+		if err == nil {
+			setSignupFields(user, r)
+
+			if err = StartOptIn(user); err == nil {
+				jsonBytes, _ = json.Marshal(webUserResponse{Data: []*User{user}, Status: "User created and confirmation message sent."})
 			}
 		}
 
 		if err != nil {
 			log.Println(err.Error())
-			jsonBytes, _ = json.Marshal(webError{Error: "Couldn't create user or send welcome message."})
+			jsonBytes, _ = json.Marshal(webError{Error: "Couldn't create user or send confirmation message."})
 		}
 	} else {
 		jsonBytes, _ = json.Marshal(webError{Error: "User already exists."})
@@ -306,6 +431,43 @@ func addUserHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(jsonBytes)
 }
 
+// Signup forms can tag users (tags=a,b) and set attributes (attr_<name>=value).
+// Only tags already in use and attributes already defined in the admin can be
+// set this way, and bad values are skipped rather than failing the signup.
+func setSignupFields(user *User, r *http.Request) {
+	for _, tag := range strings.Split(r.FormValue("tags"), ",") {
+		if strings.TrimSpace(tag) == "" {
+			continue
+		}
+
+		exists, err := TagExists(tag)
+		if err != nil || !exists {
+			log.Printf("Skipping unknown signup tag %q for %s@%s.\n", tag, user.UUID, user.Network)
+			continue
+		}
+
+		if err := user.AddTag(tag); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	for k, v := range r.Form {
+		if !strings.HasPrefix(k, "attr_") || len(v) == 0 {
+			continue
+		}
+
+		attr := &Attribute{Name: strings.TrimPrefix(k, "attr_")}
+		if err := attr.Load(); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		if err := user.SetAttribute(attr.Name, v[0], ""); err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
 type webError struct {
 	Error string `json:"error"`
 }
@@ -316,8 +478,8 @@ type webUserResponse struct {
 }
 
 func sendService() {
-	// Start email queue handler...
-	go EmailSendQueueHandler()
+	// Start send queue handler...
+	go SendQueueHandler()
 
 	// Load it up!
 	for {
@@ -339,13 +501,26 @@ func sendService() {
 }
 
 func receiveService() {
+	source, err := NewInboundSource(*InboundSourceName)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	log.Printf("Receiving messages from %s.\n", source.Name())
+
+	// Push sources are handled by the webhook endpoints, nothing to poll.
+	if _, ok := source.(*WebhookSource); ok {
+		return
+	}
+
 	for {
 		var count int
 		var err error
 
 		log.Println("Checking for received messages.")
 
-		if count, err = ProcessS3Emails("iwillvote-sms", 10); err != nil {
+		if count, err = source.Receive(10, SaveInbound); err != nil {
 			log.Println(err.Error())
 		}
 
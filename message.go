@@ -2,7 +2,7 @@ package main
 
 import (
 	"errors"
-	"fmt"
+	"log"
 	"strconv"
 	"strings"
 	"time"
@@ -35,9 +35,13 @@ func GetMessageList() ([]*Message, error) {
 func GetUserThread(uuid string, network string) ([]*Message, error) {
 	db := NewMySQL()
 
-	result, err := db.Select(`SELECT m.id AS message_id, slug, message, outgoing, m.created_on, um.id AS messageto_id, network, uuid, params, send_on, sent
+	// Outgoing messages show the version that was sent, not the current text.
+	result, err := db.Select(`SELECT m.id AS message_id, IFNULL(v.slug, m.slug), IFNULL(v.message, m.message), IFNULL(v.id, 0), IFNULL(v.version, 0), m.outgoing, m.created_on,
+		um.id AS messageto_id, um.network, um.uuid, um.params, um.send_on, um.sent, um.status, um.status_detail, um.flagged,
+		IFNULL(um.body, ''), um.transport, um.provider_id, um.provider_response, IFNULL(um.sent_on, '')
 		FROM user_message AS um
 		LEFT JOIN message AS m ON (m.id = um.message_id)
+		LEFT JOIN message_version AS v ON (v.id = um.message_version_id)
 		WHERE um.uuid=? AND um.network=?`, uuid, network)
 	if err != nil {
 		return []*Message{}, err
@@ -50,53 +54,113 @@ func GetUserThread(uuid string, network string) ([]*Message, error) {
 		msgTo := &MessageTo{}
 		paramStr := ""
 
-		result.Scan(&msg.ID, &msg.Slug, &msg.Message, &msg.Outgoing, &msg.CreatedOn, &msgTo.ID, &msgTo.Network, &msgTo.UUID, &paramStr, &msgTo.SendOn, &msgTo.Sent)
+		result.Scan(&msg.ID, &msg.Slug, &msg.Message, &msg.VersionID, &msg.Version, &msg.Outgoing, &msg.CreatedOn, &msgTo.ID, &msgTo.Network, &msgTo.UUID, &paramStr, &msgTo.SendOn, &msgTo.Sent, &msgTo.Status, &msgTo.StatusDetail, &msgTo.Flagged,
+			&msgTo.SentBody, &msgTo.Transport, &msgTo.ProviderID, &msgTo.ProviderResponse, &msgTo.SentOn)
+
+		msgTo.MessageVersionID = msg.VersionID
 
 		msgTo.Params = Mapify(paramStr)
 		msg.To = []*MessageTo{msgTo}
 		rows = append(rows, msg)
 	}
 
+	attachments, err := GetUserAttachments(uuid, network)
+	if err != nil {
+		return rows, err
+	}
+
+	for _, msg := range rows {
+		msg.To[0].Attachments = attachments[msg.To[0].ID]
+	}
+
+	return rows, nil
+}
+
+// Inbound messages from senders that don't match any user.
+func GetUnknownInbound(limit int64, offset int64) ([]*Message, error) {
+	db := NewMySQL()
+
+	result, err := db.Select(`SELECT m.id AS message_id, slug, message, outgoing, m.created_on, um.id AS messageto_id, um.network, um.uuid, um.status
+		FROM user_message AS um
+		LEFT JOIN message AS m ON (m.id = um.message_id)
+		LEFT JOIN user AS u ON (u.uuid = um.uuid AND u.network = um.network)
+		WHERE um.status = ? AND u.id IS NULL
+		ORDER BY um.id DESC LIMIT ?, ?`, DeliveryReceived, offset, limit)
+	if err != nil {
+		return []*Message{}, err
+	}
+
+	rows := []*Message{}
+
+	for result.Next() {
+		msg := &Message{}
+		msgTo := &MessageTo{}
+
+		result.Scan(&msg.ID, &msg.Slug, &msg.Message, &msg.Outgoing, &msg.CreatedOn, &msgTo.ID, &msgTo.Network, &msgTo.UUID, &msgTo.Status)
+
+		msg.To = []*MessageTo{msgTo}
+		rows = append(rows, msg)
+	}
+
 	return rows, nil
 }
 
 func GetMessagesToSend() ([]*Message, error) {
 	db := NewMySQL()
 
-	result, err := db.Select(`SELECT m.id AS message_id, slug, message, outgoing, m.created_on, um.id AS messageto_id, network, uuid, params, send_on, sent, um.created_on
+	result, err := db.Select(`SELECT m.id AS message_id, m.slug, m.message, IFNULL(m.version_id, 0), m.outgoing, m.created_on, um.id AS messageto_id, um.network, um.uuid, um.params, um.send_on, um.sent, um.status, um.quiet_ok, IFNULL(um.message_version_id, 0), um.created_on,
+		u.id, u.network, u.uuid, u.name, u.state, u.zipcode, u.created_on, u.deleted, u.landing_page, u.message_window, u.timezone, u.news, u.reminders, u.status
 		FROM user_message AS um
 		LEFT JOIN message AS m ON (m.id = um.message_id)
-		WHERE sent = 0 AND send_on < now()`)
+		LEFT JOIN campaign AS c ON (c.id = um.campaign_id)
+		JOIN user AS u ON (u.uuid = um.uuid AND u.network = um.network AND u.deleted = 0)
+		WHERE um.status = ? AND um.sent = 0 AND um.send_on < now() AND (c.id IS NULL OR c.status IN (?, ?))`,
+		DeliveryQueued, CampaignRunning, CampaignDone)
 	if err != nil {
 		return []*Message{}, err
 	}
 
 	rows := []*Message{}
+	users := []*User{}
 
 	for result.Next() {
 		msg := &Message{}
 		msgTo := &MessageTo{}
+		u := &User{}
 		paramStr := ""
 
-		result.Scan(&msg.ID, &msg.Slug, &msg.Message, &msg.Outgoing, &msg.CreatedOn, &msgTo.ID, &msgTo.Network, &msgTo.UUID, &paramStr, &msgTo.SendOn, &msgTo.Sent, &msgTo.CreatedOn)
+		result.Scan(&msg.ID, &msg.Slug, &msg.Message, &msg.VersionID, &msg.Outgoing, &msg.CreatedOn, &msgTo.ID, &msgTo.Network, &msgTo.UUID, &paramStr, &msgTo.SendOn, &msgTo.Sent, &msgTo.Status, &msgTo.QuietOK, &msgTo.MessageVersionID, &msgTo.CreatedOn,
+			&u.ID, &u.Network, &u.UUID, &u.Name, &u.State, &u.Zipcode, &u.CreatedOn, &u.Deleted, &u.LandingPage, &u.MessageWindow, &u.Timezone, &u.News, &u.Reminders, &u.Status)
 
 		msgTo.Params = Mapify(paramStr)
+		msgTo.user = u
 		msg.To = []*MessageTo{msgTo}
 		rows = append(rows, msg)
+		users = append(users, u)
+	}
+
+	// Rendering falls back to loading each user's own if this fails.
+	if err := PreloadVariables(users); err != nil {
+		log.Println(err.Error())
 	}
 
 	return rows, nil
 }
 
 type Message struct {
-	ID        int64        `json:"id"`
-	To        []*MessageTo `json:"to"`
-	Slug      string       `json:"slug"`
-	Message   string       `json:"message"`
-	Outgoing  int          `json:"outgoing"`
-	CreatedOn string       `json:"created_on"`
-	SendOn    string       `json:"send_on"`
-	Sent      int          `json:"sent"`
+	ID         int64        `json:"id"`
+	To         []*MessageTo `json:"to"`
+	Slug       string       `json:"slug"`
+	Message    string       `json:"message"`
+	Outgoing   int          `json:"outgoing"`
+	CreatedOn  string       `json:"created_on"`
+	SendOn     string       `json:"send_on"`
+	Sent       int          `json:"sent"`
+	QuietOK    int          `json:"quiet_ok"`
+	CampaignID int64        `json:"campaign_id"`
+	VersionID  int64        `json:"version_id"`
+	Version    int          `json:"version"`
+	Author     string       `json:"author"`
 }
 
 func (this *Message) Save() error {
@@ -104,6 +168,16 @@ func (this *Message) Save() error {
 		return errors.New("Missing required message and slug fields.")
 	}
 
+	if this.Outgoing == 1 {
+		if *NormalizeChars {
+			this.Message = NormalizeSmartChars(this.Message)
+		}
+
+		if err := CheckSegmentPolicy(this.Message); err != nil {
+			return err
+		}
+	}
+
 	db := NewMySQL()
 
 	var err error
@@ -121,6 +195,12 @@ func (this *Message) Save() error {
 			this.ID = newID
 		}
 	} else {
+		if this.Outgoing == 1 && this.VersionID == 0 {
+			if err := this.snapshotVersion(); err != nil {
+				return err
+			}
+		}
+
 		_, err = db.Update(
 			"UPDATE message SET slug=?, message=?, outgoing=? WHERE id=?",
 			this.Slug,
@@ -134,14 +214,32 @@ func (this *Message) Save() error {
 		return err
 	}
 
+	if this.Outgoing == 1 {
+		if err = this.saveVersion(); err != nil {
+			return err
+		}
+	}
+
 	// UserMessage Table Record
 	for _, um := range this.To {
 		um.MessageID = this.ID
 
+		if um.MessageVersionID == 0 {
+			um.MessageVersionID = this.VersionID
+		}
+
 		if um.SendOn == "" {
 			um.SendOn = this.SendOn
 		}
 
+		if this.QuietOK == 1 {
+			um.QuietOK = 1
+		}
+
+		if um.CampaignID == 0 {
+			um.CampaignID = this.CampaignID
+		}
+
 		err = um.Save()
 	}
 
@@ -154,11 +252,14 @@ func (this *Message) Save() error {
 
 func (this *Message) AddTo(uuid string, network string, params map[string]string) {
 	this.To = append(this.To, &MessageTo{
-		UUID:      uuid,
-		Network:   network,
-		MessageID: this.ID,
-		Params:    params,
-		SendOn:    this.SendOn,
+		UUID:             uuid,
+		Network:          network,
+		MessageID:        this.ID,
+		Params:           params,
+		SendOn:           this.SendOn,
+		QuietOK:          this.QuietOK,
+		CampaignID:       this.CampaignID,
+		MessageVersionID: this.VersionID,
 	})
 }
 
@@ -178,13 +279,13 @@ func (this *Message) Load() error {
 		return errors.New("Message missing required fields for load: id")
 	}
 
-	result, err := db.Select("SELECT id, message, slug, outgoing, created_on FROM message WHERE "+where+" LIMIT 1", params...)
+	result, err := db.Select("SELECT id, message, slug, outgoing, IFNULL(version_id, 0), created_on FROM message WHERE "+where+" LIMIT 1", params...)
 	if err != nil {
 		return err
 	}
 
 	for result.Next() {
-		result.Scan(&this.ID, &this.Message, &this.Slug, &this.Outgoing, &this.CreatedOn)
+		result.Scan(&this.ID, &this.Message, &this.Slug, &this.Outgoing, &this.VersionID, &this.CreatedOn)
 	}
 
 	return nil
@@ -212,7 +313,9 @@ func (this *Message) LoadTo(per int, page int) error {
 
 func (this *Message) Send() error {
 	if this.ID == 0 {
-		this.Save()
+		if err := this.Save(); err != nil {
+			return err
+		}
 	}
 
 	var errArr []error = nil
@@ -237,14 +340,79 @@ func (this *Message) Send() error {
 }
 
 type MessageTo struct {
-	ID        int64             `json:"id"`
-	MessageID int64             `json:"message_id"`
-	Network   string            `json:"network"`
-	UUID      string            `json:"uuid"`
-	Params    map[string]string `json:"params"`
-	SendOn    string            `json:"send_on"`
-	Sent      int               `json:"sent"`
-	CreatedOn string            `json:"created_on"`
+	ID               int64             `json:"id"`
+	MessageID        int64             `json:"message_id"`
+	Network          string            `json:"network"`
+	UUID             string            `json:"uuid"`
+	Params           map[string]string `json:"params"`
+	SendOn           string            `json:"send_on"`
+	Sent             int               `json:"sent"`
+	Status           string            `json:"status"`
+	StatusDetail     string            `json:"status_detail"`
+	ProviderID       string            `json:"provider_id"`
+	Flagged          int               `json:"flagged"`
+	QuietOK          int               `json:"quiet_ok"`
+	Reply            bool              `json:"-"`
+	CampaignID       int64             `json:"campaign_id"`
+	MessageVersionID int64             `json:"message_version_id"`
+	SentBody         string            `json:"sent_body"`
+	Transport        string            `json:"transport"`
+	ProviderResponse string            `json:"provider_response"`
+	SentOn           string            `json:"sent_on"`
+	Attachments      []*Attachment     `json:"attachments"`
+	CreatedOn        string            `json:"created_on"`
+	user             *User
+}
+
+// Delivery lifecycle of a user_message.
+const (
+	DeliveryQueued    = "queued"
+	DeliverySending   = "sending"
+	DeliverySent      = "sent"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+	DeliveryBounced   = "bounced"
+	DeliveryReceived  = "received"
+	DeliveryCancelled = "cancelled"
+)
+
+// Maps each delivery status to the statuses it may be reached from. Provider
+// callbacks can arrive out of order, so delivered is allowed straight from sending.
+var deliveryTransitions map[string][]string = map[string][]string{
+	DeliverySending:   {DeliveryQueued, DeliveryFailed},
+	DeliverySent:      {DeliverySending},
+	DeliveryDelivered: {DeliverySending, DeliverySent},
+	DeliveryFailed:    {DeliveryQueued, DeliverySending, DeliverySent},
+	DeliveryBounced:   {DeliverySending, DeliverySent, DeliveryDelivered},
+	DeliveryCancelled: {DeliveryQueued, DeliverySending},
+}
+
+func GetMessageToByProviderID(providerID string) (*MessageTo, error) {
+	if providerID == "" {
+		return nil, errors.New("Missing provider message id.")
+	}
+
+	db := NewMySQL()
+
+	result, err := db.Select("SELECT id FROM user_message WHERE provider_id=? LIMIT 1", providerID)
+	if err != nil {
+		return nil, err
+	}
+
+	mt := &MessageTo{}
+	for result.Next() {
+		result.Scan(&mt.ID)
+	}
+
+	if mt.ID == 0 {
+		return nil, errors.New("No message found for provider id: " + providerID)
+	}
+
+	if err := mt.Load(); err != nil {
+		return nil, err
+	}
+
+	return mt, nil
 }
 
 func (this *MessageTo) Save() error {
@@ -254,28 +422,46 @@ func (this *MessageTo) Save() error {
 
 	// Message Table Record
 	if this.ID == 0 {
+		if this.Status == "" {
+			this.Status = DeliveryQueued
+		}
+
+		// Replies stay unread until an admin opens the conversation.
+		unread := 0
+		if this.Status == DeliveryReceived {
+			unread = 1
+		}
+
 		newID, err := db.Insert(
-			"INSERT INTO user_message SET message_id=?, network=?, uuid=?, params=?, send_on=?, sent=?",
+			"INSERT INTO user_message SET message_id=?, message_version_id=?, network=?, uuid=?, params=?, send_on=?, sent=?, status=?, provider_id=?, unread=?, quiet_ok=?, campaign_id=?",
 			this.MessageID,
+			SQLNullIfZero(this.MessageVersionID),
 			this.Network,
 			this.UUID,
 			Stringify(this.Params),
 			SQLNullIfEmpty(this.SendOn),
 			this.Sent,
+			this.Status,
+			this.ProviderID,
+			unread,
+			this.QuietOK,
+			SQLNullIfZero(this.CampaignID),
 		)
 
 		if err == nil {
 			this.ID = newID
 		}
 	} else {
+		// Delivery status is only ever changed through SetStatus.
 		_, err = db.Update(
-			"UPDATE user_message SET message_id=?, network=?, uuid=?, params=?, send_on=?, sent=? WHERE id=?",
+			"UPDATE user_message SET message_id=?, message_version_id=?, network=?, uuid=?, params=?, send_on=?, provider_id=? WHERE id=?",
 			this.MessageID,
+			SQLNullIfZero(this.MessageVersionID),
 			this.Network,
 			this.UUID,
 			Stringify(this.Params),
 			SQLNullIfEmpty(this.SendOn),
-			this.Sent,
+			this.ProviderID,
 			this.ID,
 		)
 	}
@@ -300,14 +486,17 @@ func (this *MessageTo) Load() error {
 		return errors.New("Message missing required fields for load: id")
 	}
 
-	result, err := db.Select("SELECT id, message_id, network, uuid, params, send_on, sent, created_on FROM message WHERE "+where+" LIMIT 1", whereVars...)
+	result, err := db.Select(`SELECT id, message_id, IFNULL(message_version_id, 0), network, uuid, params, send_on, sent, status, status_detail, provider_id, flagged, quiet_ok,
+		IFNULL(body, ''), transport, provider_response, IFNULL(sent_on, ''), created_on
+		FROM user_message WHERE `+where+` LIMIT 1`, whereVars...)
 	if err != nil {
 		return err
 	}
 
 	for result.Next() {
 		var paramsStr string
-		result.Scan(&this.ID, &this.MessageID, &this.Network, &this.UUID, &paramsStr, &this.SendOn, &this.Sent, &this.CreatedOn)
+		result.Scan(&this.ID, &this.MessageID, &this.MessageVersionID, &this.Network, &this.UUID, &paramsStr, &this.SendOn, &this.Sent, &this.Status, &this.StatusDetail, &this.ProviderID, &this.Flagged, &this.QuietOK,
+			&this.SentBody, &this.Transport, &this.ProviderResponse, &this.SentOn, &this.CreatedOn)
 
 		this.Params = Mapify(paramsStr)
 	}
@@ -315,15 +504,140 @@ func (this *MessageTo) Load() error {
 	return nil
 }
 
-func (this *MessageTo) Body(msg *Message) string {
-	body := msg.Message
+// Marks an inbound message as needing an admin to follow up.
+func (this *MessageTo) Flag() error {
+	db := NewMySQL()
+
+	this.Flagged = 1
+
+	_, err := db.Update("UPDATE user_message SET flagged=1 WHERE id=?", this.ID)
+
+	return err
+}
+
+// Keeps the exact text handed to the transport, so threads and exports show
+// what was sent rather than re-rendering the message.
+func (this *MessageTo) SetSentBody(body string) error {
+	db := NewMySQL()
+
+	this.SentBody = body
+
+	_, err := db.Update("UPDATE user_message SET body=? WHERE id=?", this.SentBody, this.ID)
+
+	return err
+}
+
+// Records which transport sent the message, what the provider said and when.
+func (this *MessageTo) RecordSend(result *DeliveryResult) error {
+	db := NewMySQL()
 
-	if len(this.Params) == 0 {
-		return body
+	this.Transport = result.Transport
+	this.ProviderResponse = Truncate(result.Response, 255)
+
+	sentOn := result.SentOn
+	if sentOn.IsZero() {
+		sentOn = time.Now()
+	}
+
+	this.SentOn = FormatDBTime(sentOn)
+
+	_, err := db.Update(
+		"UPDATE user_message SET transport=?, provider_response=?, sent_on=? WHERE id=?",
+		this.Transport,
+		this.ProviderResponse,
+		this.SentOn,
+		this.ID,
+	)
+
+	return err
+}
+
+func (this *MessageTo) SetProviderID(id string) error {
+	db := NewMySQL()
+
+	this.ProviderID = id
+
+	_, err := db.Update("UPDATE user_message SET provider_id=? WHERE id=?", this.ProviderID, this.ID)
+
+	return err
+}
+
+// Moves the message to a new delivery status if the transition is allowed from
+// its current status. Returns false when the row was not in a valid prior state.
+func (this *MessageTo) SetStatus(status string, detail string) (bool, error) {
+	from, ok := deliveryTransitions[status]
+	if !ok {
+		return false, errors.New("Invalid delivery status: " + status)
+	}
+
+	db := NewMySQL()
+
+	sent := 0
+	if status == DeliverySent || status == DeliveryDelivered {
+		sent = 1
+	}
+
+	detail = Truncate(detail, 255)
+
+	params := []interface{}{status, detail, sent, this.ID}
+	for _, v := range from {
+		params = append(params, v)
+	}
+
+	changed, err := db.Update(
+		"UPDATE user_message SET status=?, status_detail=?, sent=? WHERE id=? AND status IN (?"+strings.Repeat(",?", len(from)-1)+")",
+		params...,
+	)
+	if err != nil || !changed {
+		return false, err
+	}
+
+	this.Status = status
+	this.StatusDetail = detail
+	this.Sent = sent
+
+	return true, nil
+}
+
+// The message text for this recipient. Outgoing messages are rendered as
+// templates, see messageContext; received ones are shown as they came in.
+func (this *MessageTo) Render(msg *Message) (string, error) {
+	if msg.Outgoing != 1 || !strings.Contains(msg.Message, "{{") && !strings.Contains(msg.Message, "[[") {
+		return msg.Message, nil
 	}
 
-	for n, v := range this.Params {
-		body = strings.Replace(body, "[["+strings.ToUpper(n)+"]]", v, -1)
+	// Unsubscribed users still get their STOP confirmation, Load fills them in
+	// even though it reports them as deleted.
+	user, _ := this.recipient()
+
+	return newMessageContext(user, this.Params).Render(msg.Message)
+}
+
+// The user the message is to, as loaded with the rest of its batch, or
+// loaded now and kept for the rest of the send.
+func (this *MessageTo) recipient() (*User, error) {
+	if this.user != nil {
+		return this.user, nil
+	}
+
+	user := &User{UUID: this.UUID, Network: this.Network}
+	err := user.Load()
+
+	this.user = user
+
+	return user, err
+}
+
+// The text as sent once it has been, otherwise as it would be rendered now,
+// falling back to the raw text for display.
+func (this *MessageTo) Body(msg *Message) string {
+	if this.SentBody != "" {
+		return this.SentBody
+	}
+
+	body, err := this.Render(msg)
+	if err != nil {
+		return msg.Message
 	}
 
 	return body
@@ -332,38 +646,113 @@ func (this *MessageTo) Body(msg *Message) string {
 func (this *MessageTo) Send(msg *Message) error {
 	var err error
 
-	if this.SendOn != "" {
-		loc, _ := time.LoadLocation("Local")
-		sendOn, _ := time.ParseInLocation("2006-01-02 15:04:05", this.SendOn, loc)
-		if time.Now().Local().Unix() < sendOn.Unix() {
-			if this.ID == 0 {
-				err = this.Save()
-			}
-
+	// Needs an ID before sending so the transport can record the provider's response.
+	if this.ID == 0 {
+		if err = this.Save(); err != nil {
 			return err
 		}
 	}
 
-	if err = this.Email(msg); err == nil {
-		this.Sent = 1
+	user, loadErr := this.recipient()
 
-		if err = this.Save(); err == nil {
+	// Only keyword replies go to someone who has unsubscribed.
+	if user.Deleted == 1 && !this.Reply {
+		_, err = this.SetStatus(DeliveryCancelled, "User unsubscribed.")
+		return err
+	}
+
+	// Until they confirm, pending users only get the confirmation itself and
+	// replies to what they text us.
+	if user.ID != 0 && user.Status != UserActive && !this.Reply && msg.Slug != *ConfirmSlug {
+		_, err = this.SetStatus(DeliveryCancelled, "User has not confirmed.")
+		return err
+	}
+
+	if this.SendOn != "" {
+		sendOn, _ := ParseDBTime(this.SendOn)
+		if time.Now().Before(sendOn) {
 			return nil
 		}
 	}
 
+	if this.SendOn != "" || this.QuietOK == 0 {
+		next := time.Now()
+
+		// Scheduled messages wait for the recipient's chosen window.
+		if this.SendOn != "" && loadErr == nil {
+			next = user.NextSendTime(next)
+		}
+
+		// Nothing goes out during the recipient's quiet hours unless it was
+		// explicitly allowed to.
+		if this.QuietOK == 0 {
+			next = QuietHoursEnd(next, user.Location())
+		}
+
+		if next.After(time.Now()) {
+			this.SendOn = FormatDBTime(next)
+			return this.Save()
+		}
+	}
+
+	// The message may have been edited since this was queued, record the
+	// version that actually goes out.
+	if msg.VersionID != 0 && this.MessageVersionID != msg.VersionID {
+		this.MessageVersionID = msg.VersionID
+		if err = this.Save(); err != nil {
+			return err
+		}
+	}
+
+	// Claim the message so it can't be picked up twice.
+	claimed, err := this.SetStatus(DeliverySending, "")
+	if err != nil || !claimed {
+		return err
+	}
+
+	if err = this.Email(msg); err != nil {
+		this.SetStatus(DeliveryFailed, err.Error())
+	}
+
 	return err
 }
 
 func (this *MessageTo) Email(msg *Message) error {
-	email := &Email{
-		From:    "sms@iwillvote.us",
-		To:      fmt.Sprintf(NetworkToDomain(this.Network), this.UUID),
-		Subject: "",
-		Body:    this.Body(msg),
+	body, err := this.Render(msg)
+	if err != nil {
+		return err
 	}
 
-	if err := email.Send(); err != nil {
+	// Names and attributes can bring their own smart characters.
+	if *NormalizeChars {
+		body = NormalizeSmartChars(body)
+	}
+
+	// Rendering only works the link out, it has to exist once it's sent.
+	if strings.Contains(msg.Message, "unsubscribe_url") {
+		user, _ := this.recipient()
+
+		link, err := UnsubscribeLink(user)
+		if err != nil {
+			return err
+		}
+
+		if err := link.Refresh(); err != nil {
+			return err
+		}
+	}
+
+	if err := this.SetSentBody(body); err != nil {
+		return err
+	}
+
+	delivery := &Delivery{
+		MessageToID: this.ID,
+		Recipient:   &Recipient{UUID: this.UUID, Network: this.Network},
+		Body:        body,
+	}
+
+	if err := delivery.Send(); err != nil {
 		return err
 	}
 
@@ -390,7 +779,32 @@ func NetworkToDomain(network string) string {
 	return ""
 }
 
+// Domains replies arrive from, including the MMS gateways that picture
+// messages and long texts come back through.
+var gatewayDomains map[string]string = map[string]string{
+	"txt.att.net":             "att",
+	"mms.att.net":             "att",
+	"mymetropcs.com":          "metropcs",
+	"messaging.sprintpcs.com": "sprint",
+	"pm.sprint.com":           "sprint",
+	"tmomail.net":             "tmobile",
+	"mmst5.tracfone.com":      "tracfone",
+	"email.uscc.net":          "uscellular",
+	"mms.uscc.net":            "uscellular",
+	"vtext.com":               "verizon",
+	"vzwpix.com":              "verizon",
+	"vmobl.com":               "virgin",
+	"vmpix.com":               "virgin",
+	"gmail.com":               "gmail",
+}
+
 func DomainToNetwork(domain string) string {
+	domain = strings.ToLower(domain)
+
+	if network, ok := gatewayDomains[domain]; ok {
+		return network
+	}
+
 	for network, match := range messageDomains {
 		if match == "%s@"+domain {
 			return network
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// Largest attachment kept from an inbound message. Anything bigger is cut
+// off there and marked truncated.
+const maxAttachmentBytes = 10 << 20
+
+type parsedMail struct {
+	Text        string
+	HTML        string
+	Attachments []*Attachment
+}
+
+// Walks a (possibly multipart) email, decoding transfer encodings and
+// charsets, and splits it into its text body and attachments.
+func parseMail(m *mail.Message) (*parsedMail, error) {
+	p := &parsedMail{}
+
+	err := walkPart(
+		m.Header.Get("Content-Type"),
+		m.Header.Get("Content-Transfer-Encoding"),
+		m.Header.Get("Content-Disposition"),
+		m.Body,
+		p,
+	)
+
+	return p, err
+}
+
+func walkPart(contentType string, encoding string, disposition string, r io.Reader, p *parsedMail) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+		params = map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(r, params["boundary"])
+
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			err = walkPart(
+				part.Header.Get("Content-Type"),
+				part.Header.Get("Content-Transfer-Encoding"),
+				part.Header.Get("Content-Disposition"),
+				part,
+				p,
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// One byte over the limit tells us whether anything was cut off.
+	data, err := ioutil.ReadAll(io.LimitReader(decodeTransfer(encoding, r), maxAttachmentBytes+1))
+	if err != nil {
+		return err
+	}
+
+	truncated := 0
+	if len(data) > maxAttachmentBytes {
+		data = data[:maxAttachmentBytes]
+		truncated = 1
+	}
+
+	dispType, dispParams, _ := mime.ParseMediaType(disposition)
+	isAttachment := dispType == "attachment"
+
+	switch {
+	case mediaType == "text/plain" && !isAttachment && p.Text == "":
+		p.Text = decodeCharset(data, params["charset"])
+	case mediaType == "text/html" && !isAttachment && p.HTML == "":
+		p.HTML = decodeCharset(data, params["charset"])
+	case strings.HasPrefix(mediaType, "text/") && !isAttachment, mediaType == "application/smil":
+		// Carrier MMS gateways tack on extra text parts, usually ads, and
+		// SMIL layout files.
+	default:
+		filename := dispParams["filename"]
+		if filename == "" {
+			filename = params["name"]
+		}
+
+		p.Attachments = append(p.Attachments, &Attachment{
+			ContentType: mediaType,
+			Filename:    filename,
+			Truncated:   truncated,
+			Data:        data,
+		})
+	}
+
+	return nil
+}
+
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &newlineStripper{r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+
+	return r
+}
+
+// base64.NewDecoder chokes on the line breaks mail clients wrap base64 with.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (this *newlineStripper) Read(p []byte) (int, error) {
+	n, err := this.r.Read(p)
+
+	j := 0
+	for _, b := range p[:n] {
+		if b != '\r' && b != '\n' && b != ' ' && b != '\t' {
+			p[j] = b
+			j++
+		}
+	}
+
+	return j, err
+}
+
+// Decodes text in any charset the WHATWG encoding spec knows by name or
+// alias, which covers what phones and mail clients send. Unknown charsets
+// are treated as UTF-8.
+func decodeCharset(data []byte, charset string) string {
+	if charset = strings.TrimSpace(charset); charset != "" {
+		if enc, err := htmlindex.Get(charset); err == nil {
+			if out, err := enc.NewDecoder().Bytes(data); err == nil {
+				data = out
+			}
+		}
+	}
+
+	if utf8.Valid(data) {
+		return string(data)
+	}
+
+	return strings.ToValidUTF8(string(data), "�")
+}
+
+var htmlBreakPattern = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>`)
+var htmlTagPattern = regexp.MustCompile(`(?s)<[^>]*>`)
+
+func htmlToText(html string) string {
+	html = htmlBreakPattern.ReplaceAllString(html, "\n")
+	text := htmlTagPattern.ReplaceAllString(html, "")
+
+	replacer := strings.NewReplacer("&nbsp;", " ", "&amp;", "&", "&lt;", "<", "&gt;", ">", "&quot;", "\"", "&#39;", "'")
+	return replacer.Replace(text)
+}
+
+// Lines that mark the start of quoted history or a signature; everything
+// from them on is dropped.
+var replyCutPatterns []*regexp.Regexp = []*regexp.Regexp{
+	regexp.MustCompile(`^-+\s*Original Message\s*-+$`),
+	regexp.MustCompile(`^_{10,}$`),
+	regexp.MustCompile(`^On .+ wrote:$`),
+	regexp.MustCompile(`^From: `),
+	regexp.MustCompile(`^-- ?$`),
+	regexp.MustCompile(`(?i)^sent from my `),
+}
+
+// Carrier footers that get appended to replies from their gateways. They're
+// only removed from the end of the body.
+var carrierFooterPatterns []*regexp.Regexp = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)^this message (was|has been) sent using the picture (and|&) video messaging`),
+	regexp.MustCompile(`(?i)^to learn how you can snap pictures with your mobile phone`),
+	regexp.MustCompile(`(?i)^sent using sms-to-email`),
+	regexp.MustCompile(`(?i)^this message was sent to you by a t-mobile`),
+	regexp.MustCompile(`(?i)^this mobile text message is brought to you by`),
+	regexp.MustCompile(`(?i)^(visit )?(https?://)?(www\.)?(verizonwireless\.com|vtext\.com|att\.net|t-mobile\.com)(/\S*)?\.?$`),
+}
+
+// Pulls just the reply out of an inbound text body.
+func extractReply(text string) string {
+	text = strings.Replace(text, "\r\n", "\n", -1)
+
+	lines := []string{}
+
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		cut := false
+		for _, re := range replyCutPatterns {
+			if re.MatchString(trimmed) {
+				cut = true
+				break
+			}
+		}
+
+		if cut {
+			break
+		}
+
+		if !strings.HasPrefix(trimmed, ">") {
+			lines = append(lines, line)
+		}
+	}
+
+	// Drop footer lines, and the blank lines between them, off the end.
+	for len(lines) > 0 {
+		trimmed := strings.TrimSpace(lines[len(lines)-1])
+
+		footer := trimmed == ""
+		for _, re := range carrierFooterPatterns {
+			if re.MatchString(trimmed) {
+				footer = true
+				break
+			}
+		}
+
+		if !footer {
+			break
+		}
+
+		lines = lines[:len(lines)-1]
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
@@ -42,6 +42,10 @@ func SQLNullIfEmpty(v string) sql.NullString {
 	return sql.NullString{v, vIsNotNull}
 }
 
+func SQLNullIfZero(v int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: v, Valid: v != 0}
+}
+
 type MySQLConfig struct {
 	Host       string
 	User       string
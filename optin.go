@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// New signups get a confirmation message with a link code and are only
+// welcomed, and scheduled for reminders, once they reply YES or open the
+// link. Unconfirmed signups expire along with their link.
+func StartOptIn(user *User) error {
+	if user.ID == 0 {
+		return errors.New("User must be saved before it can be confirmed.")
+	}
+
+	link := &Link{
+		Action:    "confirm",
+		UserID:    user.ID,
+		ExpiresIn: int64(ConfirmExpiry.Seconds()),
+	}
+
+	if err := link.Save(); err != nil {
+		return err
+	}
+
+	msg := &Message{Slug: *ConfirmSlug}
+	if err := msg.Load(); err != nil {
+		return err
+	}
+
+	if msg.ID == 0 {
+		return errors.New("Confirmation message does not exist: " + *ConfirmSlug)
+	}
+
+	// Sent straight away, the user is waiting on it.
+	msg.QuietOK = 1
+	msg.AddTo(user.UUID, user.Network, map[string]string{"hash": link.Hash})
+
+	return msg.Send()
+}
+
+// Activates a pending user and sends the welcome message.
+func ConfirmOptIn(user *User, consent *Consent) error {
+	if user.Status != UserPending {
+		return errors.New("User is not awaiting confirmation.")
+	}
+
+	user.Status = UserActive
+	if err := user.Save(); err != nil {
+		return err
+	}
+
+	if err := consent.Record(user); err != nil {
+		return err
+	}
+
+	msg := &Message{Slug: "welcome"}
+	if err := msg.Load(); err != nil {
+		return err
+	}
+
+	msg.QuietOK = 1
+	msg.AddTo(user.UUID, user.Network, nil)
+
+	if err := msg.Send(); err != nil {
+		return err
+	}
+
+	// Reminders are best effort, the confirmation itself succeeded.
+	if err := ScheduleElectionReminders(user); err != nil {
+		log.Println(err.Error())
+	}
+
+	return nil
+}
+
+// Expires pending users without a confirmation link sent within the expiry.
+func ExpirePendingUsers() (int64, error) {
+	db := NewMySQL()
+
+	cutoff := FormatDBTime(time.Now().Add(-*ConfirmExpiry))
+
+	result, err := db.Select(`SELECT u.id FROM user AS u
+		WHERE u.status = ? AND NOT EXISTS (
+			SELECT 1 FROM link AS l WHERE l.user_id = u.id AND l.action = 'confirm' AND l.created_on > ?
+		)`, UserPending, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []int64
+	for result.Next() {
+		var id int64
+		if err := result.Scan(&id); err != nil {
+			return 0, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	var count int64
+	for _, id := range ids {
+		expired, err := expirePendingUser(id)
+		if err != nil {
+			return count, err
+		}
+
+		if expired {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// Expires the user unless they confirmed in the meantime, cancels whatever
+// is still queued for them and records it in the consent ledger.
+func expirePendingUser(id int64) (bool, error) {
+	db := NewMySQL()
+
+	changed, err := db.Update("UPDATE user SET status=?, deleted=1 WHERE id=? AND status=?", UserExpired, id, UserPending)
+	if err != nil || !changed {
+		return false, err
+	}
+
+	// Load reports deleted users as an error, but still fills them in.
+	user := &User{ID: id}
+	if err := user.Load(); err != nil && user.CreatedOn == "" {
+		return true, err
+	}
+
+	if err := user.cancelSends("Signup expired."); err != nil {
+		return true, err
+	}
+
+	consent := NewConsent(ConsentExpire, ConsentSourceSystem, nil)
+	consent.Detail = "Not confirmed within " + ConfirmExpiry.String() + "."
+
+	return true, consent.Record(user)
+}
+
+func optInService() {
+	for {
+		count, err := ExpirePendingUsers()
+		if err != nil {
+			log.Println(err.Error())
+		}
+
+		if count > 0 {
+			log.Printf("Expired %d unconfirmed signups.\n", count)
+		}
+
+		time.Sleep(1000 * time.Millisecond * 60 * 60) // 1 hour
+	}
+}
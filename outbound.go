@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// Outbound queue statuses. A pending row is leased by a worker by setting
+// lease_owner and leased_until, so a crashed worker's rows become available
+// again once the lease runs out.
+const (
+	OutboundPending   = "pending"
+	OutboundDone      = "done"
+	OutboundDead      = "dead"
+	OutboundCancelled = "cancelled"
+)
+
+// Long enough for every send in a batch to hit its timeout before the lease
+// runs out. Otherwise another worker could pick up a row mid-send. Rate limit
+// waits have to fit in what's left of the lease, a row that would wait longer
+// is held and leased again later.
+const outboundBatchSize = 5
+const outboundLeaseSeconds = 300
+const outboundSendTimeout = 30 * time.Second
+const outboundRateLimitHold = 30 * time.Second
+
+func GetDeadDeliveries(limit int64, offset int64) ([]*Delivery, error) {
+	db := NewMySQL()
+
+	result, err := db.Select(`SELECT id, user_message_id, network, uuid, body, status, attempts, last_error, created_on
+		FROM outbound
+		WHERE status=?
+		ORDER BY id DESC LIMIT ?, ?`, OutboundDead, offset, limit)
+	if err != nil {
+		return []*Delivery{}, err
+	}
+
+	rows := []*Delivery{}
+
+	for result.Next() {
+		d := &Delivery{Recipient: &Recipient{}}
+
+		err := result.Scan(&d.ID, &d.MessageToID, &d.Recipient.Network, &d.Recipient.UUID, &d.Body, &d.Status, &d.Attempts, &d.LastError, &d.CreatedOn)
+		if err != nil {
+			return rows, err
+		}
+
+		rows = append(rows, d)
+	}
+
+	return rows, nil
+}
+
+// Leases up to limit due rows for owner. The UPDATE is a single statement so
+// concurrent workers never end up holding the same row.
+func LeaseDeliveries(owner string, limit int) ([]*Delivery, error) {
+	db := NewMySQL()
+
+	// Taken before the lease starts, so it's never later than the real one.
+	leasedUntil := time.Now().Add(outboundLeaseSeconds * time.Second)
+
+	_, err := db.Update(`UPDATE outbound
+		SET lease_owner=?, leased_until=NOW() + INTERVAL ? SECOND, attempts=attempts+1
+		WHERE status=? AND next_attempt_on <= NOW() AND (leased_until IS NULL OR leased_until < NOW())
+		ORDER BY id LIMIT ?`, owner, outboundLeaseSeconds, OutboundPending, limit)
+	if err != nil {
+		return []*Delivery{}, err
+	}
+
+	result, err := db.Select(`SELECT id, user_message_id, network, uuid, body, status, attempts, last_error, created_on
+		FROM outbound
+		WHERE lease_owner=? AND status=? AND leased_until > NOW()`, owner, OutboundPending)
+	if err != nil {
+		return []*Delivery{}, err
+	}
+
+	rows := []*Delivery{}
+
+	for result.Next() {
+		d := &Delivery{Recipient: &Recipient{}, LeaseOwner: owner, LeasedUntil: leasedUntil}
+
+		err := result.Scan(&d.ID, &d.MessageToID, &d.Recipient.Network, &d.Recipient.UUID, &d.Body, &d.Status, &d.Attempts, &d.LastError, &d.CreatedOn)
+		if err != nil {
+			return rows, err
+		}
+
+		rows = append(rows, d)
+	}
+
+	return rows, nil
+}
+
+// Cancels the pending deliveries matching where, against the outbound and
+// user_message tables aliased as o and um, that no worker holds a lease on,
+// and marks their user_message rows cancelled with detail.
+func cancelDeliveries(detail string, where string, whereVars ...interface{}) error {
+	db := NewMySQL()
+
+	// Cancelled first, so a row leased in between is left to finish sending.
+	_, err := db.Update(`UPDATE outbound AS o JOIN user_message AS um ON (um.id = o.user_message_id)
+		SET o.status=?, o.last_error=?
+		WHERE o.status=? AND (o.leased_until IS NULL OR o.leased_until < NOW()) AND `+where,
+		append([]interface{}{OutboundCancelled, detail, OutboundPending}, whereVars...)...)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Update(`UPDATE user_message AS um JOIN outbound AS o ON (o.user_message_id = um.id)
+		SET um.status=?, um.status_detail=?
+		WHERE o.status=? AND um.status=? AND `+where,
+		append([]interface{}{DeliveryCancelled, detail, OutboundCancelled, DeliverySending}, whereVars...)...)
+
+	return err
+}
+
+// Stops everything still waiting to go out to a recipient.
+func CancelRecipientDeliveries(uuid string, network string, detail string) error {
+	return cancelDeliveries(detail, "um.uuid=? AND um.network=?", uuid, network)
+}
+
+// Stops everything of a campaign's still waiting to go out.
+func CancelCampaignDeliveries(campaignID int64, detail string) error {
+	return cancelDeliveries(detail, "um.campaign_id=?", campaignID)
+}
+
+type Delivery struct {
+	ID          int64
+	MessageToID int64
+	Recipient   *Recipient
+	Body        string
+	Status      string
+	Attempts    int
+	LastError   string
+	LeaseOwner  string
+	LeasedUntil time.Time
+	CreatedOn   string
+}
+
+// Adds the delivery to the outbound queue.
+func (this *Delivery) Send() error {
+	if this.Recipient == nil || this.Recipient.UUID == "" || this.Body == "" {
+		return errors.New("Delivery record not complete enough to send.")
+	}
+
+	db := NewMySQL()
+
+	this.Status = OutboundPending
+
+	newID, err := db.Insert(
+		"INSERT INTO outbound SET user_message_id=?, network=?, uuid=?, body=?, status=?",
+		this.MessageToID,
+		this.Recipient.Network,
+		this.Recipient.UUID,
+		this.Body,
+		this.Status,
+	)
+	if err != nil {
+		return err
+	}
+
+	this.ID = newID
+
+	return nil
+}
+
+func (this *Delivery) Load() error {
+	if this.ID == 0 {
+		return errors.New("Delivery missing required fields for load: id")
+	}
+
+	db := NewMySQL()
+
+	result, err := db.Select(`SELECT id, user_message_id, network, uuid, body, status, attempts, last_error, created_on
+		FROM outbound WHERE id=? LIMIT 1`, this.ID)
+	if err != nil {
+		return err
+	}
+
+	this.Recipient = &Recipient{}
+
+	for result.Next() {
+		err = result.Scan(&this.ID, &this.MessageToID, &this.Recipient.Network, &this.Recipient.UUID, &this.Body, &this.Status, &this.Attempts, &this.LastError, &this.CreatedOn)
+		if err != nil {
+			return err
+		}
+	}
+
+	if this.CreatedOn == "" {
+		return errors.New("Delivery not found.")
+	}
+
+	return nil
+}
+
+func (this *Delivery) Done() error {
+	db := NewMySQL()
+
+	_, err := db.Update(
+		"UPDATE outbound SET status=?, leased_until=NULL WHERE id=? AND lease_owner=?",
+		OutboundDone,
+		this.ID,
+		this.LeaseOwner,
+	)
+
+	if err == nil {
+		this.Status = OutboundDone
+	}
+
+	return err
+}
+
+// Gives the delivery back to the queue to try again after wait, without using
+// up an attempt.
+func (this *Delivery) Hold(wait time.Duration) error {
+	db := NewMySQL()
+
+	_, err := db.Update(
+		"UPDATE outbound SET attempts=attempts-1, leased_until=NULL, next_attempt_on=NOW() + INTERVAL ? SECOND WHERE id=? AND lease_owner=?",
+		int64(wait.Seconds()),
+		this.ID,
+		this.LeaseOwner,
+	)
+
+	return err
+}
+
+// Whether the recipient opted out after the delivery was queued. Rows leased
+// by a worker are left alone by cancelDeliveries, so the worker checks this
+// itself once it's done waiting. Replies queued after the opt-out, like the
+// STOP confirmation, still go.
+func (this *Delivery) OptedOutSince() (bool, error) {
+	db := NewMySQL()
+
+	result, err := db.Select(`SELECT COUNT(*)
+		FROM outbound AS o
+		JOIN consent AS c ON (c.uuid = o.uuid AND c.network = o.network)
+		WHERE o.id=? AND c.event=? AND c.created_on > o.created_on`, this.ID, ConsentOptOut)
+	if err != nil {
+		return false, err
+	}
+
+	var count int
+	for result.Next() {
+		if err := result.Scan(&count); err != nil {
+			return false, err
+		}
+	}
+
+	return count > 0, nil
+}
+
+// When the delivery may go out: now, or when the recipient's quiet hours end.
+// Messages allowed through quiet hours, which includes replies, and test
+// sends go out any time.
+func (this *Delivery) QuietUntil() (time.Time, error) {
+	now := time.Now()
+
+	if this.MessageToID == 0 {
+		return now, nil
+	}
+
+	db := NewMySQL()
+
+	result, err := db.Select(`SELECT um.quiet_ok, IFNULL(u.timezone, ''), IFNULL(u.state, ''), IFNULL(u.zipcode, 0)
+		FROM user_message AS um
+		LEFT JOIN user AS u ON (u.uuid = um.uuid AND u.network = um.network)
+		WHERE um.id=? LIMIT 1`, this.MessageToID)
+	if err != nil {
+		return now, err
+	}
+
+	quietOK := 0
+	user := &User{}
+	for result.Next() {
+		if err := result.Scan(&quietOK, &user.Timezone, &user.State, &user.Zipcode); err != nil {
+			return now, err
+		}
+	}
+
+	if quietOK == 1 {
+		return now, nil
+	}
+
+	return QuietHoursEnd(now, user.Location()), nil
+}
+
+// Drops a leased delivery without sending it.
+func (this *Delivery) Cancel(detail string) error {
+	db := NewMySQL()
+
+	_, err := db.Update(
+		"UPDATE outbound SET status=?, last_error=?, leased_until=NULL WHERE id=? AND lease_owner=?",
+		OutboundCancelled,
+		detail,
+		this.ID,
+		this.LeaseOwner,
+	)
+	if err != nil {
+		return err
+	}
+
+	this.Status = OutboundCancelled
+
+	if this.MessageToID != 0 {
+		mt := &MessageTo{ID: this.MessageToID}
+		_, err = mt.SetStatus(DeliveryCancelled, detail)
+	}
+
+	return err
+}
+
+// Schedules another attempt with exponential backoff, or dead-letters the
+// delivery once it has used up its attempts or the error is permanent.
+func (this *Delivery) Fail(sendErr error) error {
+	db := NewMySQL()
+
+	this.LastError = Truncate(sendErr.Error(), 255)
+
+	permanent := false
+	if smsErr, ok := sendErr.(*SMSError); ok {
+		permanent = smsErr.Permanent()
+	}
+
+	if permanent || this.Attempts >= *SendMaxAttempts {
+		_, err := db.Update(
+			"UPDATE outbound SET status=?, last_error=?, leased_until=NULL WHERE id=? AND lease_owner=?",
+			OutboundDead,
+			this.LastError,
+			this.ID,
+			this.LeaseOwner,
+		)
+
+		if err == nil {
+			this.Status = OutboundDead
+		}
+
+		return err
+	}
+
+	_, err := db.Update(
+		"UPDATE outbound SET last_error=?, leased_until=NULL, next_attempt_on=NOW() + INTERVAL ? SECOND WHERE id=? AND lease_owner=?",
+		this.LastError,
+		int64(outboundBackoff(this.Attempts).Seconds()),
+		this.ID,
+		this.LeaseOwner,
+	)
+
+	return err
+}
+
+// Puts a dead letter back on the queue with a fresh set of attempts.
+func (this *Delivery) Requeue() error {
+	db := NewMySQL()
+
+	changed, err := db.Update(
+		"UPDATE outbound SET status=?, attempts=0, next_attempt_on=NOW(), lease_owner=NULL, leased_until=NULL WHERE id=? AND status=?",
+		OutboundPending,
+		this.ID,
+		OutboundDead,
+	)
+	if err != nil {
+		return err
+	}
+
+	if !changed {
+		return errors.New("Delivery is not in the dead letter queue.")
+	}
+
+	this.Status = OutboundPending
+	this.Attempts = 0
+
+	mt := &MessageTo{ID: this.MessageToID}
+	_, err = mt.SetStatus(DeliverySending, "requeued")
+
+	return err
+}
+
+// 30s, 1m, 2m, 4m... capped at an hour.
+func outboundBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	d := time.Duration(math.Pow(2, float64(attempts-1))) * 30 * time.Second
+	if d > time.Hour || d <= 0 {
+		d = time.Hour
+	}
+
+	return d
+}
+
+func SendQueueHandler() {
+	for i := 0; i < *SendWorkers; i++ {
+		go sendWorker(i)
+	}
+}
+
+func sendWorker(n int) {
+	for {
+		owner := fmt.Sprintf("%d-%s", n, randomToken())
+
+		deliveries, err := LeaseDeliveries(owner, outboundBatchSize)
+		if err != nil {
+			log.Println(err.Error())
+		}
+
+		if len(deliveries) == 0 {
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		for _, delivery := range deliveries {
+			deliver(delivery)
+		}
+	}
+}
+
+func deliver(delivery *Delivery) {
+	mt := &MessageTo{ID: delivery.MessageToID}
+
+	// Campaign sends already queued here still stop when the campaign is
+	// paused or cancelled.
+	if delivery.MessageToID != 0 {
+		status, err := GetCampaignStatusForMessageTo(delivery.MessageToID)
+		if err != nil {
+			log.Println(err.Error())
+		}
+
+		switch status {
+		case CampaignPaused:
+			if err := delivery.Hold(campaignHoldWait); err != nil {
+				log.Println(err.Error())
+			}
+			return
+		case CampaignCancelled:
+			if err := delivery.Cancel("Campaign cancelled."); err != nil {
+				log.Println(err.Error())
+			}
+			return
+		}
+	}
+
+	// Quiet hours are checked again here, retries, held rows and requeued
+	// dead letters can all come due in the middle of the night.
+	if next, err := delivery.QuietUntil(); err != nil {
+		log.Println(err.Error())
+	} else if wait := next.Sub(time.Now()); wait > 0 {
+		if err := delivery.Hold(wait); err != nil {
+			log.Println(err.Error())
+		}
+		return
+	}
+
+	transport, err := TransportForNetwork(delivery.Recipient.Network)
+	if err == nil {
+		// The wait and the send both have to finish inside the lease.
+		waitCtx, cancelWait := context.WithDeadline(context.Background(), delivery.LeasedUntil.Add(-outboundSendTimeout))
+		err = WaitToSend(waitCtx, transport.Name(), delivery.Recipient.Network)
+		cancelWait()
+
+		if err != nil {
+			if err := delivery.Hold(outboundRateLimitHold); err != nil {
+				log.Println(err.Error())
+			}
+			return
+		}
+
+		if optedOut, err := delivery.OptedOutSince(); err != nil {
+			log.Println(err.Error())
+		} else if optedOut {
+			if err := delivery.Cancel("User unsubscribed."); err != nil {
+				log.Println(err.Error())
+			}
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), outboundSendTimeout)
+
+		var result *DeliveryResult
+		result, err = transport.Send(ctx, delivery.Recipient, delivery.Body)
+		cancel()
+
+		if err == nil {
+			if err := delivery.Done(); err != nil {
+				log.Println(err.Error())
+			}
+
+			// Test sends have no user_message to update.
+			if delivery.MessageToID == 0 {
+				return
+			}
+
+			if result.Transport == "" {
+				result.Transport = transport.Name()
+			}
+
+			if err := mt.RecordSend(result); err != nil {
+				log.Println(err.Error())
+			}
+
+			if result.ProviderID != "" {
+				if err := mt.SetProviderID(result.ProviderID); err != nil {
+					log.Println(err.Error())
+				}
+			}
+
+			if _, err := mt.SetStatus(DeliverySent, result.Response); err != nil {
+				log.Println(err.Error())
+			}
+
+			return
+		}
+	}
+
+	log.Printf("Delivery %d attempt %d failed: %s\n", delivery.ID, delivery.Attempts, err.Error())
+
+	handleSendError(delivery, err)
+
+	if err := delivery.Fail(err); err != nil {
+		log.Println(err.Error())
+	}
+
+	if delivery.Status == OutboundDead && delivery.MessageToID != 0 {
+		mt.SetStatus(DeliveryFailed, delivery.LastError)
+	}
+}
+
+// Acts on provider errors that tell us something about the recipient.
+func handleSendError(delivery *Delivery, err error) {
+	smsErr, ok := err.(*SMSError)
+	if !ok || !smsErr.Permanent() {
+		return
+	}
+
+	if smsErr.Code == 21610 {
+		user := &User{UUID: delivery.Recipient.UUID, Network: delivery.Recipient.Network}
+		if err := user.Load(); err == nil {
+			log.Printf("Unsubscribing %s@%s, provider reports they opted out.\n", user.UUID, user.Network)
+			consent := NewConsent(ConsentOptOut, ConsentSourceCarrier, nil)
+			consent.Detail = smsErr.Error()
+
+			if err := user.Unsubscribe(consent); err != nil {
+				log.Println(err.Error())
+			}
+		}
+	}
+}
+
+func randomToken() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Prefix on test sends so staff can't mistake them for the real thing.
+const testSendPrefix = "[TEST] "
+
+// Staff phones from -test-numbers, uuid@network separated by commas.
+func TestNumbers() []*Recipient {
+	numbers := []*Recipient{}
+
+	for _, v := range strings.Split(*TestNumberList, ",") {
+		parts := strings.Split(strings.TrimSpace(v), "@")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+
+		numbers = append(numbers, &Recipient{UUID: parts[0], Network: parts[1]})
+	}
+
+	return numbers
+}
+
+func IsTestNumber(uuid string, network string) bool {
+	for _, r := range TestNumbers() {
+		if r.UUID == uuid && r.Network == network {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Params typed into the preview form, query string style, e.g.
+// "hash=abc123&election=general".
+func ParsePreviewParams(in string) (map[string]string, error) {
+	params := map[string]string{}
+
+	query, err := url.ParseQuery(strings.TrimSpace(in))
+	if err != nil {
+		return params, errors.New("Params must look like name=value&name=value.")
+	}
+
+	for k, v := range query {
+		if k == "" {
+			return params, errors.New("Params must look like name=value&name=value.")
+		}
+
+		params[k] = v[len(v)-1]
+	}
+
+	return params, nil
+}
+
+// Renders a message as the user would receive it, or as the sample recipient
+// would when user is nil. Params are merged over the sample's. Previews and
+// test sends end up in front of staff, so the user's unsubscribe link is
+// swapped for a stand in that nobody can unsubscribe them with.
+func PreviewMessage(msg *Message, user *User, params map[string]string) (string, error) {
+	ctx := sampleMessageContext()
+
+	for k, v := range params {
+		ctx.Params[strings.ToLower(k)] = v
+	}
+
+	if user != nil {
+		ctx = newMessageContext(user, ctx.Params)
+		ctx.standInLinks = true
+	}
+
+	body, err := ctx.Render(msg.Message)
+	if err != nil {
+		return "", err
+	}
+
+	if *NormalizeChars {
+		body = NormalizeSmartChars(body)
+	}
+
+	return body, nil
+}
+
+// Queues a rendered body straight to a staff phone. Nothing is written to
+// user_message, so test sends never show up in anyone's thread or reports.
+func SendTestMessage(body string, to *Recipient) error {
+	if !IsTestNumber(to.UUID, to.Network) {
+		return errors.New("Not a configured test number: " + to.UUID + "@" + to.Network)
+	}
+
+	delivery := &Delivery{
+		Recipient: to,
+		Body:      testSendPrefix + body,
+	}
+
+	return delivery.Send()
+}
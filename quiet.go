@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Quiet hours, [start, end) in the recipient's local time, wrapping past
+// midnight when start is after end. Nothing but replies to the user and
+// admin-overridden alerts is sent during them.
+var quietHours [2]int
+var quietHoursEnabled bool
+
+// Reads -quiet-hours. Called once at startup so a typo stops the server
+// instead of quietly turning quiet hours off.
+func loadQuietHours() error {
+	if *QuietHours == "" {
+		return nil
+	}
+
+	parts := strings.SplitN(*QuietHours, "-", 2)
+	if len(parts) != 2 {
+		return errors.New("Invalid -quiet-hours, use start-end in hours, e.g. 21-8: " + *QuietHours)
+	}
+
+	start, err1 := strconv.Atoi(parts[0])
+	end, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || start < 0 || start > 23 || end < 0 || end > 23 || start == end {
+		return errors.New("Invalid -quiet-hours, use start-end in hours, e.g. 21-8: " + *QuietHours)
+	}
+
+	quietHours = [2]int{start, end}
+	quietHoursEnabled = true
+
+	return nil
+}
+
+func InQuietHours(t time.Time, loc *time.Location) bool {
+	if !quietHoursEnabled {
+		return false
+	}
+
+	hour := t.In(loc).Hour()
+
+	if quietHours[0] < quietHours[1] {
+		return hour >= quietHours[0] && hour < quietHours[1]
+	}
+
+	return hour >= quietHours[0] || hour < quietHours[1]
+}
+
+// Returns t if it falls outside quiet hours, otherwise when they end.
+func QuietHoursEnd(t time.Time, loc *time.Location) time.Time {
+	if !InQuietHours(t, loc) {
+		return t
+	}
+
+	local := t.In(loc)
+
+	end := time.Date(local.Year(), local.Month(), local.Day(), quietHours[1], 0, 0, 0, loc)
+	if !end.After(local) {
+		end = end.AddDate(0, 0, 1)
+	}
+
+	return end
+}
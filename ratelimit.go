@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token bucket shared by every worker sending through the same transport or
+// carrier domain. Each Wait reserves a token up front, so concurrent callers
+// queue up behind each other instead of all waking at once.
+//
+// A Wait that couldn't finish before its context's deadline gives up straight
+// away and leaves the token for someone else.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst float64) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &TokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+var ErrRateLimitDeadline = errors.New("Rate limit wait would pass the deadline.")
+
+func (this *TokenBucket) reserve(deadline time.Time) (time.Duration, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+	this.tokens += now.Sub(this.last).Seconds() * this.rate
+	if this.tokens > this.burst {
+		this.tokens = this.burst
+	}
+	this.last = now
+
+	if this.tokens >= 1 {
+		this.tokens--
+		return 0, nil
+	}
+
+	wait := time.Duration((1 - this.tokens) / this.rate * float64(time.Second))
+	if !deadline.IsZero() && now.Add(wait).After(deadline) {
+		return 0, ErrRateLimitDeadline
+	}
+
+	this.tokens--
+
+	return wait, nil
+}
+
+func (this *TokenBucket) Wait(ctx context.Context) error {
+	deadline, _ := ctx.Deadline()
+
+	wait, err := this.reserve(deadline)
+	if err != nil || wait == 0 {
+		return err
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var rateLimiters map[string]*TokenBucket
+
+// Builds the buckets from -rate-limits, keyed by transport name or carrier
+// gateway domain. Values are sends per second, optionally with a burst size
+// after a colon, e.g. "ses=14&twilio=10:20&vtext.com=0.5". Called once at
+// startup so a bad limit stops the server instead of being ignored.
+func loadRateLimiters() error {
+	if *DefaultSendRate <= 0 {
+		return fmt.Errorf("Invalid -send-rate %v, it must be more than 0.", *DefaultSendRate)
+	}
+
+	limiters := map[string]*TokenBucket{}
+
+	for _, entry := range strings.Split(*RateLimits, "&") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return errors.New("Invalid rate limit, use name=rate or name=rate:burst: " + entry)
+		}
+
+		key, v := kv[0], kv[1]
+		parts := strings.SplitN(v, ":", 2)
+
+		rate, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || rate <= 0 {
+			return errors.New("Invalid rate limit for " + key + ", the rate must be a number more than 0: " + v)
+		}
+
+		burst := rate
+		if len(parts) == 2 {
+			burst, err = strconv.ParseFloat(parts[1], 64)
+			if err != nil || burst < 1 {
+				return errors.New("Invalid rate limit for " + key + ", the burst must be a number of at least 1: " + v)
+			}
+		}
+
+		limiters[key] = NewTokenBucket(rate, burst)
+	}
+
+	// Transports without their own limit get the default rate.
+	for name := range transports {
+		if _, ok := limiters[name]; !ok {
+			limiters[name] = NewTokenBucket(*DefaultSendRate, *DefaultSendRate)
+		}
+	}
+
+	rateLimiters = limiters
+
+	return nil
+}
+
+// Blocks until both the transport and the recipient's carrier domain have
+// room for another send. Direct SMS never touches the carrier gateways.
+func WaitToSend(ctx context.Context, transport string, network string) error {
+	if limiter, ok := rateLimiters[transport]; ok {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	if transport == "twilio" {
+		return nil
+	}
+
+	domain := strings.TrimPrefix(NetworkToDomain(network), "%s@")
+	if limiter, ok := rateLimiters[domain]; ok && domain != "" {
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Outgoing message bodies are templates. Besides the usual {{if}}, {{else}},
+// eq, and, or and not they can use:
+//
+//	{{name}} {{state}} {{zipcode}} {{tags}}   the recipient's fields
+//	{{attr "household_size"}}                 a custom attribute
+//	{{has_tag "needs-ride"}}                  whether the recipient is tagged
+//	{{param "hash"}}                          a param the message was sent with
+//	{{election_type}} {{election_date}} {{registration_deadline}}
+//	{{early_voting_start}} {{early_voting_end}} {{absentee_request_deadline}}
+//	                                          the next election in their state
+//	{{code_url}}                              link for the send's hash param
+//	{{unsubscribe_url}}                       the recipient's unsubscribe link
+//	{{site_url "/faq"}}                       any other page
+//	{{name | default "there"}}                a fallback for empty values
+//
+// The older [[HASH]] style placeholders are still filled in afterwards.
+type messageContext struct {
+	User     *User
+	Vars     map[string]string
+	Params   map[string]string
+	Election *Election
+
+	// Gives links that act on the user a stand in, for bodies that go
+	// anywhere but to the user.
+	standInLinks bool
+}
+
+// Election dates are written out the way people say them.
+const messageDateFormat = "Monday, January 2"
+
+func newMessageContext(user *User, params map[string]string) *messageContext {
+	ctx := &messageContext{
+		User:   user,
+		Vars:   user.Variables(),
+		Params: params,
+	}
+
+	for _, e := range GetCalendar().UpcomingForState(user.State, time.Now()) {
+		if ctx.Election == nil || e.Date.Before(ctx.Election.Date) {
+			ctx.Election = e
+		}
+	}
+
+	return ctx
+}
+
+func (this *messageContext) electionDate(event string) func() string {
+	return func() string {
+		if this.Election == nil {
+			return ""
+		}
+
+		day := this.Election.EventDate(event)
+		if day.IsZero() {
+			return ""
+		}
+
+		return day.Format(messageDateFormat)
+	}
+}
+
+func (this *messageContext) funcs() template.FuncMap {
+	funcs := template.FuncMap{
+		"name":    func() string { return this.Vars["name"] },
+		"state":   func() string { return this.Vars["state"] },
+		"zipcode": func() string { return this.Vars["zipcode"] },
+		"tags":    func() string { return this.Vars["tags"] },
+		"attr": func(name string) string {
+			return this.Vars[strings.ToLower(name)]
+		},
+		"has_tag": func(tag string) bool {
+			tag, _ = NormalizeTag(tag)
+			for _, t := range strings.Split(this.Vars["tags"], ", ") {
+				if t == tag {
+					return true
+				}
+			}
+
+			return false
+		},
+		"param": func(name string) string {
+			return this.Params[strings.ToLower(name)]
+		},
+		"election_type": func() string {
+			if this.Election == nil {
+				return ""
+			}
+
+			return this.Election.Type
+		},
+		"code_url": func() (string, error) {
+			if this.Params["hash"] == "" {
+				return "", errors.New("Message has no link code to use in code_url, only the unsub and " + *ConfirmSlug + " messages do.")
+			}
+
+			return *BaseURL + "/code/" + this.Params["hash"], nil
+		},
+		"unsubscribe_url": func() (string, error) {
+			// The sample recipient gets a stand in the same length as the real thing.
+			if this.User.ID == 0 || this.standInLinks {
+				return *BaseURL + "/code/" + strings.Repeat("0", 40), nil
+			}
+
+			link, err := UnsubscribeLink(this.User)
+			if err != nil {
+				return "", err
+			}
+
+			return *BaseURL + "/code/" + link.Hash, nil
+		},
+		"site_url": func(path string) string {
+			return *BaseURL + "/" + strings.TrimPrefix(path, "/")
+		},
+		"default": func(fallback string, v interface{}) string {
+			if s, ok := v.(string); ok && strings.TrimSpace(s) != "" {
+				return s
+			}
+
+			return fallback
+		},
+	}
+
+	for event := range electionEvents {
+		funcs[event] = this.electionDate(event)
+	}
+
+	return funcs
+}
+
+func (this *messageContext) Render(body string) (string, error) {
+	tmpl, err := template.New("message").Funcs(this.funcs()).Parse(body)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, nil); err != nil {
+		return "", err
+	}
+
+	body = out.String()
+
+	// The send's own params take precedence.
+	for n, v := range this.Params {
+		body = strings.Replace(body, "[["+strings.ToUpper(n)+"]]", v, -1)
+	}
+
+	for n, v := range this.Vars {
+		body = strings.Replace(body, "[["+strings.ToUpper(n)+"]]", v, -1)
+	}
+
+	return body, nil
+}
+
+// A made up recipient for checking and measuring messages.
+func sampleMessageContext() *messageContext {
+	return &messageContext{
+		User: &User{UUID: "5555555555", Network: "sms", Name: "Sample", State: "OH", Zipcode: 43215},
+		Vars: map[string]string{
+			"name":    "Sample",
+			"state":   "OH",
+			"zipcode": "43215",
+			"tags":    "",
+		},
+		Params: map[string]string{"hash": makeHash()},
+		Election: &Election{
+			State: "OH",
+			Type:  "General",
+			Date:  time.Now().AddDate(0, 1, 0),
+		},
+	}
+}
+
+// Only these are sent with a link code in their hash param.
+func sendsLinkCode(slug string) bool {
+	return slug == "unsub" || slug == *ConfirmSlug
+}
+
+// Checks a message body by rendering it for the sample recipient, so typos in
+// variable names or helpers are caught before anything is sent.
+func ValidateMessageTemplate(slug string, body string) error {
+	ctx := sampleMessageContext()
+	if !sendsLinkCode(slug) {
+		delete(ctx.Params, "hash")
+	}
+
+	if _, err := ctx.Render(body); err != nil {
+		return errors.New("Invalid message template: " + strings.TrimPrefix(err.Error(), "template: "))
+	}
+
+	return nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Auto-responder rules answer common inbound questions ("where do I vote?")
+// with a canned message. A rule matches when its pattern matches the reply
+// and, if it has one, the sender is in its state. A rule with only a state
+// matches every reply from that state. A matching rule can also tag the
+// sender and set an attribute on them, written name=value.
+type ResponderRule struct {
+	ID        int64  `json:"id"`
+	Name      string `json:"name"`
+	MatchType string `json:"match_type"`
+	Pattern   string `json:"pattern"`
+	State     string `json:"state"`
+	ReplySlug string `json:"reply_slug"`
+	Tag       string `json:"tag"`
+	Attribute string `json:"attribute"`
+	Priority  int    `json:"priority"`
+	Enabled   int    `json:"enabled"`
+	CreatedOn string `json:"created_on"`
+	re        *regexp.Regexp
+}
+
+const (
+	RuleMatchKeyword = "keyword"
+	RuleMatchRegex   = "regex"
+)
+
+// Rules in the order they're tried: highest priority first, then oldest.
+func GetResponderRules(enabledOnly bool) ([]*ResponderRule, error) {
+	db := NewMySQL()
+
+	where := ""
+	if enabledOnly {
+		where = "WHERE enabled=1"
+	}
+
+	result, err := db.Select(`SELECT id, name, match_type, pattern, state, reply_slug, tag, attribute, priority, enabled, created_on
+		FROM responder_rule ` + where + `
+		ORDER BY priority DESC, id ASC`)
+	if err != nil {
+		return []*ResponderRule{}, err
+	}
+
+	rules := []*ResponderRule{}
+
+	for result.Next() {
+		rule := &ResponderRule{}
+
+		err := result.Scan(&rule.ID, &rule.Name, &rule.MatchType, &rule.Pattern, &rule.State, &rule.ReplySlug, &rule.Tag, &rule.Attribute, &rule.Priority, &rule.Enabled, &rule.CreatedOn)
+		if err != nil {
+			return rules, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// The first rule matching the reply, or nil.
+func MatchResponderRule(rules []*ResponderRule, body string, state string) *ResponderRule {
+	for _, rule := range rules {
+		if rule.Matches(body, state) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+func (this *ResponderRule) Validate() error {
+	if this.Name == "" || this.ReplySlug == "" {
+		return errors.New("Missing required name and reply message fields.")
+	}
+
+	switch this.MatchType {
+	case RuleMatchKeyword:
+	case RuleMatchRegex:
+		if _, err := regexp.Compile(this.Pattern); err != nil {
+			return errors.New("Invalid regular expression: " + err.Error())
+		}
+	default:
+		return errors.New("Unknown match type: " + this.MatchType)
+	}
+
+	if this.Pattern == "" && this.State == "" {
+		return errors.New("A rule needs a pattern, a state or both.")
+	}
+
+	if this.Tag != "" {
+		tag, err := NormalizeTag(this.Tag)
+		if err != nil {
+			return err
+		}
+
+		this.Tag = tag
+	}
+
+	if this.Attribute != "" {
+		name, value, err := this.attribute()
+		if err != nil {
+			return err
+		}
+
+		// Attributes that don't exist yet are created as strings when the
+		// rule first fires, so only known types can be checked here.
+		attr := &Attribute{Name: name}
+		if attr.Load() == nil {
+			if _, err := attr.Normalize(value); err != nil {
+				return err
+			}
+		} else if !attributeNamePattern.MatchString(name) {
+			return errors.New("Attribute names must be lowercase letters, numbers and underscores.")
+		}
+	}
+
+	msg := &Message{Slug: this.ReplySlug}
+	if err := msg.Load(); err != nil || msg.ID == 0 {
+		return errors.New("Reply message does not exist: " + this.ReplySlug)
+	}
+
+	return nil
+}
+
+// Keyword patterns are a comma separated list of words or phrases, any of
+// which may appear anywhere in the reply. Regex patterns are matched case
+// insensitively.
+func (this *ResponderRule) Matches(body string, state string) bool {
+	if this.State != "" && !strings.EqualFold(this.State, state) {
+		return false
+	}
+
+	if this.Pattern == "" {
+		return true
+	}
+
+	switch this.MatchType {
+	case RuleMatchKeyword:
+		words := " " + strings.Join(strings.FieldsFunc(strings.ToLower(body), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		}), " ") + " "
+
+		for _, keyword := range strings.Split(strings.ToLower(this.Pattern), ",") {
+			keyword = strings.Join(strings.Fields(keyword), " ")
+			if keyword != "" && strings.Contains(words, " "+keyword+" ") {
+				return true
+			}
+		}
+	case RuleMatchRegex:
+		if this.re == nil {
+			re, err := regexp.Compile("(?i)" + this.Pattern)
+			if err != nil {
+				log.Println(err.Error())
+				return false
+			}
+
+			this.re = re
+		}
+
+		return this.re.MatchString(body)
+	}
+
+	return false
+}
+
+func (this *ResponderRule) Save() error {
+	if err := this.Validate(); err != nil {
+		return err
+	}
+
+	db := NewMySQL()
+
+	var err error
+
+	if this.ID == 0 {
+		newID, err := db.Insert(
+			"INSERT INTO responder_rule SET name=?, match_type=?, pattern=?, state=?, reply_slug=?, tag=?, attribute=?, priority=?, enabled=?",
+			this.Name,
+			this.MatchType,
+			this.Pattern,
+			this.State,
+			this.ReplySlug,
+			this.Tag,
+			this.Attribute,
+			this.Priority,
+			this.Enabled,
+		)
+
+		if err == nil {
+			this.ID = newID
+		}
+	} else {
+		_, err = db.Update(
+			"UPDATE responder_rule SET name=?, match_type=?, pattern=?, state=?, reply_slug=?, tag=?, attribute=?, priority=?, enabled=? WHERE id=?",
+			this.Name,
+			this.MatchType,
+			this.Pattern,
+			this.State,
+			this.ReplySlug,
+			this.Tag,
+			this.Attribute,
+			this.Priority,
+			this.Enabled,
+			this.ID,
+		)
+	}
+
+	return err
+}
+
+func (this *ResponderRule) SetEnabled(enabled int) error {
+	db := NewMySQL()
+
+	_, err := db.Update("UPDATE responder_rule SET enabled=? WHERE id=?", enabled, this.ID)
+	if err == nil {
+		this.Enabled = enabled
+	}
+
+	return err
+}
+
+func (this *ResponderRule) Delete() error {
+	db := NewMySQL()
+
+	_, err := db.Update("DELETE FROM responder_rule WHERE id=?", this.ID)
+
+	return err
+}
+
+// Splits the rule's name=value attribute.
+func (this *ResponderRule) attribute() (string, string, error) {
+	parts := strings.SplitN(this.Attribute, "=", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("Attributes to set look like name=value.")
+	}
+
+	return strings.ToLower(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1]), nil
+}
+
+// Replies with the rule's message and tags the sender.
+func (this *ResponderRule) Apply(in *MessageTo, user *User) error {
+	if this.Tag != "" && user.ID != 0 {
+		if err := user.AddTag(this.Tag); err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	if this.Attribute != "" && user.ID != 0 {
+		if name, value, err := this.attribute(); err == nil {
+			if err := user.SetAttribute(name, value, ""); err != nil {
+				log.Println(err.Error())
+			}
+		}
+	}
+
+	log.Printf("Auto-responder rule %q matched reply from %s@%s.\n", this.Name, in.UUID, in.Network)
+
+	return replyWithSlug(this.ReplySlug, in)
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Audience filters select users by their fields and activity. Filters are
+// stored with Stringify, so values can't contain & or =.
+//
+//	state           two letter state, or several separated by commas
+//	landing_page    signup landing page
+//	joined_after    signed up on or after this date, YYYY-MM-DD
+//	joined_before   signed up before this date, YYYY-MM-DD
+//	message_window  morning, afternoon or evening
+//	news            1 or 0
+//	reminders       1 or 0
+//	replied         1 for users who have texted us, 0 for those who haven't
+//	clicked         1 for users who have opened a link we sent, 0 otherwise
+//	received        slug of a message the user was sent
+//	not_received    slug of a message the user was not sent
+//	tag             tag the user has
+//	not_tag         tag the user doesn't have
+//	attr_<name>     custom attribute value, or not it after a !, or for
+//	                numbers and dates more or less than it with > or <
+var audienceFilters map[string]string = map[string]string{
+	"state":          "State",
+	"landing_page":   "Landing page",
+	"joined_after":   "Joined on or after",
+	"joined_before":  "Joined before",
+	"message_window": "Message window",
+	"news":           "News",
+	"reminders":      "Reminders",
+	"replied":        "Has replied",
+	"clicked":        "Has clicked a link",
+	"received":       "Received message",
+	"not_received":   "Didn't receive message",
+	"tag":            "Tagged",
+	"not_tag":        "Not tagged",
+}
+
+const audienceDateFormat = "2006-01-02"
+
+// Builds the WHERE conditions, against the user table aliased as u, for an
+// audience. Only active, confirmed users are ever included.
+func audienceWhere(filters map[string]string) ([]string, []interface{}, error) {
+	where := []string{"u.deleted = 0", "u.status = ?"}
+	whereVars := []interface{}{UserActive}
+
+	keys := []string{}
+	for k := range filters {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := strings.TrimSpace(filters[k])
+		if v == "" {
+			continue
+		}
+
+		switch k {
+		case "state":
+			states := strings.Split(strings.ToUpper(v), ",")
+			where = append(where, "u.state IN (?"+strings.Repeat(",?", len(states)-1)+")")
+			for _, s := range states {
+				whereVars = append(whereVars, strings.TrimSpace(s))
+			}
+		case "landing_page", "message_window":
+			where = append(where, "u."+k+" = ?")
+			whereVars = append(whereVars, v)
+		case "joined_after", "joined_before":
+			day, err := time.ParseInLocation(audienceDateFormat, v, time.Local)
+			if err != nil {
+				return nil, nil, errors.New("Invalid date for " + k + ", use YYYY-MM-DD.")
+			}
+
+			op := ">="
+			if k == "joined_before" {
+				op = "<"
+			}
+
+			where = append(where, "u.created_on "+op+" ?")
+			whereVars = append(whereVars, FormatDBTime(day))
+		case "news", "reminders":
+			if v != "0" && v != "1" {
+				return nil, nil, errors.New("Invalid value for " + k + ", use 1 or 0.")
+			}
+
+			where = append(where, "u."+k+" = ?")
+			whereVars = append(whereVars, v)
+		case "replied", "clicked":
+			if v != "0" && v != "1" {
+				return nil, nil, errors.New("Invalid value for " + k + ", use 1 or 0.")
+			}
+
+			exists := "EXISTS"
+			if v == "0" {
+				exists = "NOT EXISTS"
+			}
+
+			if k == "replied" {
+				where = append(where, exists+" (SELECT 1 FROM user_message AS r WHERE r.uuid = u.uuid AND r.network = u.network AND r.status = ?)")
+				whereVars = append(whereVars, DeliveryReceived)
+			} else {
+				where = append(where, exists+" (SELECT 1 FROM link AS l WHERE l.user_id = u.id AND l.clicks > 0)")
+			}
+		case "received", "not_received":
+			exists := "EXISTS"
+			if k == "not_received" {
+				exists = "NOT EXISTS"
+			}
+
+			where = append(where, exists+` (SELECT 1 FROM user_message AS rm JOIN message AS m ON (m.id = rm.message_id)
+				WHERE rm.uuid = u.uuid AND rm.network = u.network AND rm.sent = 1 AND m.slug = ?)`)
+			whereVars = append(whereVars, strings.ToLower(v))
+		case "tag", "not_tag":
+			tag, err := NormalizeTag(v)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			exists := "EXISTS"
+			if k == "not_tag" {
+				exists = "NOT EXISTS"
+			}
+
+			where = append(where, exists+" (SELECT 1 FROM user_tag AS t WHERE t.user_id = u.id AND t.tag = ?)")
+			whereVars = append(whereVars, tag)
+		default:
+			if !strings.HasPrefix(k, "attr_") {
+				return nil, nil, errors.New("Unknown audience filter: " + k)
+			}
+
+			cond, condVars, err := attributeCondition(strings.TrimPrefix(k, "attr_"), v)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			where = append(where, cond)
+			whereVars = append(whereVars, condVars...)
+		}
+	}
+
+	return where, whereVars, nil
+}
+
+func ValidateAudience(filters map[string]string) error {
+	for k, v := range filters {
+		if strings.ContainsAny(k+v, "&=") {
+			return errors.New("Audience filters can't contain & or =.")
+		}
+	}
+
+	_, _, err := audienceWhere(filters)
+
+	return err
+}
+
+// Users matching an audience, paged by id.
+func ListAudienceUsers(filters map[string]string, afterID int64, limit int64) ([]*User, error) {
+	db := NewMySQL()
+
+	var userList []*User
+
+	where, whereVars, err := audienceWhere(filters)
+	if err != nil {
+		return userList, err
+	}
+
+	where = append(where, "u.id > ?")
+	whereVars = append(whereVars, afterID, limit)
+
+	result, err := db.Select(`SELECT
+		u.id, u.network, u.uuid, u.name, u.state, u.zipcode, u.created_on, u.deleted, u.landing_page, u.message_window, u.timezone, u.news, u.reminders, u.status
+		FROM user AS u WHERE `+strings.Join(where, " AND ")+` ORDER BY u.id LIMIT ?`,
+		whereVars...)
+	if err != nil {
+		return userList, err
+	}
+
+	for result.Next() {
+		u := &User{}
+		err := result.Scan(&u.ID, &u.Network, &u.UUID, &u.Name, &u.State, &u.Zipcode, &u.CreatedOn, &u.Deleted, &u.LandingPage, &u.MessageWindow, &u.Timezone, &u.News, &u.Reminders, &u.Status)
+		if err != nil {
+			return userList, err
+		}
+
+		userList = append(userList, u)
+	}
+
+	return userList, nil
+}
+
+func CountAudience(filters map[string]string) (int64, error) {
+	db := NewMySQL()
+
+	where, whereVars, err := audienceWhere(filters)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := db.Select("SELECT COUNT(*) FROM user AS u WHERE "+strings.Join(where, " AND "), whereVars...)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for result.Next() {
+		result.Scan(&count)
+	}
+
+	return count, nil
+}
+
+// A saved, named audience.
+type Segment struct {
+	ID        int64             `json:"id"`
+	Name      string            `json:"name"`
+	Filters   map[string]string `json:"filters"`
+	Count     int64             `json:"count"`
+	CreatedOn string            `json:"created_on"`
+}
+
+func GetSegments() ([]*Segment, error) {
+	db := NewMySQL()
+
+	result, err := db.Select("SELECT id, name, filters, created_on FROM segment ORDER BY name")
+	if err != nil {
+		return []*Segment{}, err
+	}
+
+	segments := []*Segment{}
+
+	for result.Next() {
+		s := &Segment{}
+		filtersStr := ""
+
+		if err := result.Scan(&s.ID, &s.Name, &filtersStr, &s.CreatedOn); err != nil {
+			return segments, err
+		}
+
+		s.Filters = Mapify(filtersStr)
+		segments = append(segments, s)
+	}
+
+	return segments, nil
+}
+
+func (this *Segment) Save() error {
+	if this.Name == "" {
+		return errors.New("Missing required name field.")
+	}
+
+	if err := ValidateAudience(this.Filters); err != nil {
+		return err
+	}
+
+	db := NewMySQL()
+
+	var err error
+
+	if this.ID == 0 {
+		newID, err := db.Insert("INSERT INTO segment SET name=?, filters=?", this.Name, Stringify(this.Filters))
+
+		if err == nil {
+			this.ID = newID
+		}
+	} else {
+		_, err = db.Update("UPDATE segment SET name=?, filters=? WHERE id=?", this.Name, Stringify(this.Filters), this.ID)
+	}
+
+	return err
+}
+
+func (this *Segment) Load() error {
+	if this.ID == 0 {
+		return errors.New("Segment missing required fields for load: id")
+	}
+
+	db := NewMySQL()
+
+	result, err := db.Select("SELECT id, name, filters, created_on FROM segment WHERE id=? LIMIT 1", this.ID)
+	if err != nil {
+		return err
+	}
+
+	for result.Next() {
+		filtersStr := ""
+
+		if err := result.Scan(&this.ID, &this.Name, &filtersStr, &this.CreatedOn); err != nil {
+			return err
+		}
+
+		this.Filters = Mapify(filtersStr)
+	}
+
+	if this.CreatedOn == "" {
+		return errors.New("Segment not found.")
+	}
+
+	return nil
+}
+
+func (this *Segment) Delete() error {
+	db := NewMySQL()
+
+	_, err := db.Update("DELETE FROM segment WHERE id=?", this.ID)
+
+	return err
+}
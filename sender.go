@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"unicode"
+)
+
+type Sender struct {
+	UUID    string
+	Network string
+	User    *User
+}
+
+// Works out who an inbound message is from. The address is parsed properly
+// so display names and encoded headers don't get in the way, gateway domains
+// are mapped to carriers for both SMS and MMS, and the phone number is
+// matched to a user even if they signed up on a different network.
+func ResolveSender(from string) *Sender {
+	addr := from
+	if parsed, err := mail.ParseAddress(from); err == nil {
+		addr = parsed.Address
+	}
+
+	sender := &Sender{}
+
+	if at := strings.LastIndex(addr, "@"); at != -1 {
+		sender.UUID = NormalizePhone(addr[:at])
+		sender.Network = DomainToNetwork(addr[at+1:])
+
+		if sender.Network == "" {
+			sender.Network = "unknown"
+		}
+	} else {
+		// Direct SMS, the sender is just a phone number.
+		sender.UUID = NormalizePhone(addr)
+		sender.Network = "sms"
+	}
+
+	if sender.UUID == "" {
+		sender.UUID = addr
+
+		// Users on networks like gmail are stored by the address's local part.
+		if at := strings.LastIndex(addr, "@"); at != -1 && strings.HasPrefix(NetworkToDomain(sender.Network), "%s@") {
+			sender.UUID = addr[:at]
+		}
+	}
+
+	if user, err := FindUserByPhone(sender.UUID, sender.Network); err == nil && user != nil {
+		sender.User = user
+		sender.Network = user.Network
+	}
+
+	return sender
+}
+
+// Strips formatting and the US country code, leaving the 10 digit number
+// users are stored under. Returns "" if it isn't a phone number.
+func NormalizePhone(in string) string {
+	digits := strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+
+		return -1
+	}, in)
+
+	if len(digits) == 11 && strings.HasPrefix(digits, "1") {
+		digits = digits[1:]
+	}
+
+	if len(digits) != 10 {
+		return ""
+	}
+
+	return digits
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Twilio error codes that will never succeed on retry.
+var smsPermanentErrors map[int]string = map[int]string{
+	21211: "invalid number",
+	21408: "region not enabled",
+	21610: "recipient unsubscribed",
+	21612: "unreachable number",
+	21614: "not a mobile number",
+}
+
+type SMSError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  int    `json:"status"`
+}
+
+func (this *SMSError) Error() string {
+	return fmt.Sprintf("SMS provider error %d: %s", this.Code, this.Message)
+}
+
+func (this *SMSError) Permanent() bool {
+	_, ok := smsPermanentErrors[this.Code]
+	return ok
+}
+
+// Delivers messages directly through a Twilio-compatible REST API, configured
+// with SMS_ACCOUNT_SID, SMS_AUTH_TOKEN, SMS_FROM and optionally SMS_BASE_URL
+// to point at a local mock server.
+type SMSTransport struct {
+	Client *http.Client
+}
+
+func (this *SMSTransport) Name() string {
+	return "twilio"
+}
+
+func (this *SMSTransport) Send(ctx context.Context, recipient *Recipient, body string) (*DeliveryResult, error) {
+	sid := os.Getenv("SMS_ACCOUNT_SID")
+	token := os.Getenv("SMS_AUTH_TOKEN")
+	from := os.Getenv("SMS_FROM")
+
+	if sid == "" || token == "" || from == "" {
+		return nil, errors.New("SMS gateway not configured.")
+	}
+
+	baseURL := os.Getenv("SMS_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://api.twilio.com"
+	}
+
+	form := url.Values{}
+	form.Set("To", E164(recipient.UUID))
+	form.Set("From", from)
+	form.Set("Body", body)
+
+	req, err := http.NewRequest(
+		"POST",
+		strings.TrimRight(baseURL, "/")+"/2010-04-01/Accounts/"+sid+"/Messages.json",
+		strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(sid, token)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := this.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		smsErr := &SMSError{Status: resp.StatusCode}
+		if err := json.Unmarshal(raw, smsErr); err != nil || smsErr.Message == "" {
+			smsErr.Message = resp.Status
+		}
+
+		return nil, smsErr
+	}
+
+	result := struct {
+		SID          string `json:"sid"`
+		Status       string `json:"status"`
+		ErrorCode    int    `json:"error_code"`
+		ErrorMessage string `json:"error_message"`
+	}{}
+
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, err
+	}
+
+	if result.ErrorCode != 0 {
+		return nil, &SMSError{Code: result.ErrorCode, Message: result.ErrorMessage, Status: resp.StatusCode}
+	}
+
+	return &DeliveryResult{
+		Transport:  this.Name(),
+		ProviderID: result.SID,
+		Response:   result.Status,
+		SentOn:     time.Now(),
+	}, nil
+}
+
+// Formats a 10 digit US phone number as +1XXXXXXXXXX.
+func E164(uuid string) string {
+	if strings.HasPrefix(uuid, "+") {
+		return uuid
+	}
+
+	if len(uuid) == 11 && strings.HasPrefix(uuid, "1") {
+		return "+" + uuid
+	}
+
+	return "+1" + uuid
+}
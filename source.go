@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type InboundMessage struct {
+	From        string
+	Body        string
+	Attachments []*Attachment
+}
+
+// Builds an inbound message from a raw email, keeping just the reply text
+// and any attachments.
+func InboundFromMail(m *mail.Message) (*InboundMessage, error) {
+	parsed, err := parseMail(m)
+	if err != nil {
+		return nil, err
+	}
+
+	text := parsed.Text
+	if text == "" && parsed.HTML != "" {
+		text = htmlToText(parsed.HTML)
+	}
+
+	return &InboundMessage{
+		From:        m.Header.Get("From"),
+		Body:        extractReply(text),
+		Attachments: parsed.Attachments,
+	}, nil
+}
+
+type InboundHandler func(*InboundMessage) error
+
+type InboundSource interface {
+	Name() string
+	// Receive pulls up to limit waiting messages and passes each to handle,
+	// only removing it from the source once handle succeeds. Push sources
+	// deliver as messages arrive and return 0.
+	Receive(limit int64, handle InboundHandler) (int, error)
+}
+
+func NewInboundSource(name string) (InboundSource, error) {
+	switch name {
+	case "s3":
+		return &S3Source{Bucket: *InboundBucket}, nil
+	case "maildir":
+		return &MaildirSource{Dir: *InboundMaildir}, nil
+	case "webhook":
+		return &WebhookSource{}, nil
+	}
+
+	return nil, errors.New("Unknown inbound source: " + name)
+}
+
+// Emails written to an S3 bucket by an SES receipt rule.
+type S3Source struct {
+	Bucket string
+}
+
+func (this *S3Source) Name() string {
+	return "s3"
+}
+
+func (this *S3Source) Receive(limit int64, handle InboundHandler) (int, error) {
+	svc := s3.New(session.New())
+
+	params := &s3.ListObjectsInput{
+		Bucket:  aws.String(this.Bucket),
+		MaxKeys: aws.Int64(limit),
+	}
+
+	resp, err := svc.ListObjects(params)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, obj := range resp.Contents {
+
+		// Get the S3 object
+		params := &s3.GetObjectInput{
+			Bucket: aws.String(this.Bucket),
+			Key:    aws.String(*obj.Key),
+		}
+
+		resp, err := svc.GetObject(params)
+
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		// Parse the email
+		m, err := mail.ReadMessage(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		in, err := InboundFromMail(m)
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		if err := handle(in); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		// Remove the object
+		delParams := &s3.DeleteObjectInput{
+			Bucket: aws.String(this.Bucket),
+			Key:    aws.String(*obj.Key),
+		}
+
+		if _, err := svc.DeleteObject(delParams); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+	}
+
+	return len(resp.Contents), nil
+}
+
+// A local Maildir, handy for development. Messages are read from new/ and
+// moved to cur/ once handled.
+type MaildirSource struct {
+	Dir string
+}
+
+func (this *MaildirSource) Name() string {
+	return "maildir"
+}
+
+func (this *MaildirSource) Receive(limit int64, handle InboundHandler) (int, error) {
+	files, err := ioutil.ReadDir(filepath.Join(this.Dir, "new"))
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	for _, file := range files {
+		if int64(count) >= limit {
+			break
+		}
+
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		count++
+
+		path := filepath.Join(this.Dir, "new", file.Name())
+		claimed := filepath.Join(this.Dir, "cur", file.Name()+":2,")
+
+		// Claim the message before handling it, so it can't be handled twice
+		// however the rest goes. If this fails someone else has it.
+		if err := os.Rename(path, claimed); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		// Marks the claimed message with maildir flags: S once it's handled,
+		// F for messages that can't be read, left for someone to look at.
+		mark := func(flags string) {
+			if err := os.Rename(claimed, claimed+flags); err != nil {
+				log.Println(err.Error())
+			}
+		}
+
+		raw, err := ioutil.ReadFile(claimed)
+		if err != nil {
+			log.Println(err.Error())
+			mark("F")
+			continue
+		}
+
+		m, err := mail.ReadMessage(bytes.NewReader(raw))
+		if err != nil {
+			log.Println(err.Error())
+			mark("F")
+			continue
+		}
+
+		in, err := InboundFromMail(m)
+		if err != nil {
+			log.Println(err.Error())
+			mark("F")
+			continue
+		}
+
+		// Nothing was saved, so put it back to try again on the next poll.
+		if err := handle(in); err != nil {
+			log.Println(err.Error())
+			if err := os.Rename(claimed, path); err != nil {
+				log.Println(err.Error())
+			}
+			continue
+		}
+
+		mark("S")
+	}
+
+	return count, nil
+}
+
+// Inbound messages pushed over HTTP, either SES receipt notifications through
+// SNS or SMS provider inbound webhooks.
+type WebhookSource struct{}
+
+func (this *WebhookSource) Name() string {
+	return "webhook"
+}
+
+func (this *WebhookSource) Receive(limit int64, handle InboundHandler) (int, error) {
+	return 0, nil
+}
+
+type sesReceiptNotification struct {
+	NotificationType string `json:"notificationType"`
+	Content          string `json:"content"`
+	Receipt          struct {
+		Action struct {
+			Encoding string `json:"encoding"`
+		} `json:"action"`
+	} `json:"receipt"`
+}
+
+// Accepts SES receipt notifications from an SNS action carrying the raw email.
+func sesInboundWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !webhookAuthorized(r) {
+		http.Error(w, "Forbidden.", 403)
+		return
+	}
+
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad request.", 400)
+		return
+	}
+
+	envelope := &snsEnvelope{}
+	if err := json.Unmarshal(raw, envelope); err != nil {
+		http.Error(w, "Bad request.", 400)
+		return
+	}
+
+	switch envelope.Type {
+	case "SubscriptionConfirmation":
+		confirmSNSSubscription(envelope.SubscribeURL)
+	case "Notification":
+		notification := &sesReceiptNotification{}
+		if err := json.Unmarshal([]byte(envelope.Message), notification); err != nil || notification.NotificationType != "Received" {
+			http.Error(w, "Bad request.", 400)
+			return
+		}
+
+		content := []byte(notification.Content)
+		if strings.ToUpper(notification.Receipt.Action.Encoding) == "BASE64" {
+			if content, err = base64.StdEncoding.DecodeString(notification.Content); err != nil {
+				http.Error(w, "Bad request.", 400)
+				return
+			}
+		}
+
+		m, err := mail.ReadMessage(bytes.NewReader(content))
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, "Bad request.", 400)
+			return
+		}
+
+		in, err := InboundFromMail(m)
+		if err == nil {
+			err = SaveInbound(in)
+		}
+
+		if err != nil {
+			log.Println(err.Error())
+			http.Error(w, "Internal server error.", 500)
+			return
+		}
+	}
+
+	w.WriteHeader(200)
+}
+
+// Accepts Twilio-style inbound SMS webhooks.
+func smsInboundWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !webhookAuthorized(r) {
+		http.Error(w, "Forbidden.", 403)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil || r.FormValue("From") == "" {
+		http.Error(w, "Bad request.", 400)
+		return
+	}
+
+	in := &InboundMessage{
+		From: r.FormValue("From"),
+		Body: r.FormValue("Body"),
+	}
+
+	if err := SaveInbound(in); err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Internal server error.", 500)
+		return
+	}
+
+	// Empty TwiML so the provider doesn't send a reply of its own.
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write([]byte("<Response></Response>"))
+}
@@ -0,0 +1,11 @@
+CREATE TABLE `attachment` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `user_message_id` int(11) unsigned NOT NULL,
+  `content_type` varchar(100) NOT NULL DEFAULT '',
+  `filename` varchar(255) NOT NULL DEFAULT '',
+  `path` varchar(60) NOT NULL DEFAULT '',
+  `truncated` tinyint(1) NOT NULL DEFAULT '0',
+  `created_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `user_message_id` (`user_message_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
\ No newline at end of file
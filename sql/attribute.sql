@@ -0,0 +1,6 @@
+CREATE TABLE `attribute` (
+  `name` varchar(50) NOT NULL DEFAULT '',
+  `type` varchar(10) NOT NULL DEFAULT 'string',
+  `created_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
\ No newline at end of file
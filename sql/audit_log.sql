@@ -0,0 +1,10 @@
+CREATE TABLE `audit_log` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `admin` varchar(50) NOT NULL DEFAULT '',
+  `action` varchar(50) NOT NULL DEFAULT '',
+  `detail` text NOT NULL,
+  `ip` varchar(45) NOT NULL DEFAULT '',
+  `created_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `action` (`action`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
\ No newline at end of file
@@ -0,0 +1,16 @@
+-- Run once when upgrading to message versions. Messages from before then
+-- have none; keep their current text as version 1 and pin the sends that
+-- went out with it, so the first edit doesn't rewrite them.
+INSERT INTO message_version (message_id, version, slug, message, created_by, created_on)
+SELECT id, 1, slug, message, '', created_on FROM message
+WHERE outgoing = 1 AND version_id IS NULL;
+
+UPDATE message AS m
+JOIN message_version AS v ON (v.message_id = m.id AND v.version = 1)
+SET m.version_id = v.id
+WHERE m.version_id IS NULL;
+
+UPDATE user_message AS um
+JOIN message AS m ON (m.id = um.message_id)
+SET um.message_version_id = m.version_id
+WHERE um.message_version_id IS NULL AND m.outgoing = 1;
\ No newline at end of file
@@ -0,0 +1,9 @@
+-- Run once when upgrading to delivery statuses. Rows from before then all
+-- default to queued; give them the status they actually have so they aren't
+-- picked up and sent again.
+UPDATE user_message AS um
+JOIN message AS m ON (m.id = um.message_id)
+SET um.status = 'received'
+WHERE um.status = 'queued' AND m.outgoing = 0;
+
+UPDATE user_message SET status = 'sent' WHERE status = 'queued' AND sent = 1;
\ No newline at end of file
@@ -0,0 +1,3 @@
+-- Run once when upgrading to reminders that respect the user's choice. Signups
+-- used to be saved with reminders=0 even though they'd asked to be reminded.
+UPDATE user SET reminders = 1 WHERE reminders = 0;
\ No newline at end of file
@@ -0,0 +1,16 @@
+CREATE TABLE `campaign` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `name` varchar(100) NOT NULL DEFAULT '',
+  `message_id` int(11) unsigned NOT NULL,
+  `segment_id` int(11) unsigned DEFAULT NULL,
+  `audience` text NOT NULL,
+  `send_on` varchar(20) NOT NULL DEFAULT '',
+  `quiet_ok` tinyint(1) NOT NULL DEFAULT '0',
+  `status` varchar(10) NOT NULL DEFAULT 'running',
+  `cursor_id` int(11) unsigned NOT NULL DEFAULT '0',
+  `queued` int(11) unsigned NOT NULL DEFAULT '0',
+  `created_by` varchar(50) NOT NULL DEFAULT '',
+  `created_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `status` (`status`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
\ No newline at end of file
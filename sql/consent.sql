@@ -0,0 +1,16 @@
+CREATE TABLE `consent` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) unsigned NOT NULL,
+  `network` varchar(50) NOT NULL DEFAULT '',
+  `uuid` varchar(100) NOT NULL DEFAULT '',
+  `event` varchar(20) NOT NULL DEFAULT '',
+  `source` varchar(20) NOT NULL DEFAULT '',
+  `ip` varchar(45) NOT NULL DEFAULT '',
+  `user_agent` varchar(255) NOT NULL DEFAULT '',
+  `terms_version` varchar(20) NOT NULL DEFAULT '',
+  `detail` varchar(255) NOT NULL DEFAULT '',
+  `created_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `user_id` (`user_id`),
+  KEY `uuid` (`uuid`,`network`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
\ No newline at end of file
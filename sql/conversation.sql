@@ -0,0 +1,7 @@
+CREATE TABLE `conversation` (
+  `user_id` int(11) unsigned NOT NULL,
+  `assigned_to` varchar(50) NOT NULL DEFAULT '',
+  `updated_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`user_id`),
+  KEY `assigned_to` (`assigned_to`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
\ No newline at end of file
@@ -0,0 +1,11 @@
+CREATE TABLE `election_reminder` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `election` varchar(60) NOT NULL DEFAULT '',
+  `slug` varchar(100) NOT NULL DEFAULT '',
+  `user_id` int(11) unsigned NOT NULL,
+  `user_message_id` int(11) unsigned DEFAULT NULL,
+  `created_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `reminder` (`election`,`slug`,`user_id`),
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
\ No newline at end of file
@@ -3,6 +3,7 @@ CREATE TABLE `message` (
   `slug` varchar(100) NOT NULL DEFAULT '',
   `message` text NOT NULL,
   `outgoing` tinyint(1) NOT NULL DEFAULT '1',
+  `version_id` int(11) unsigned DEFAULT NULL,
   `created_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
   PRIMARY KEY (`id`),
   UNIQUE KEY `slug` (`slug`(25))
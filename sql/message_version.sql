@@ -0,0 +1,11 @@
+CREATE TABLE `message_version` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `message_id` int(11) unsigned NOT NULL,
+  `version` int(11) unsigned NOT NULL,
+  `slug` varchar(100) NOT NULL DEFAULT '',
+  `message` text NOT NULL,
+  `created_by` varchar(100) NOT NULL DEFAULT '',
+  `created_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `message_version` (`message_id`,`version`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
\ No newline at end of file
@@ -0,0 +1,18 @@
+CREATE TABLE `outbound` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `user_message_id` int(11) unsigned NOT NULL,
+  `network` varchar(50) NOT NULL DEFAULT '',
+  `uuid` varchar(100) NOT NULL DEFAULT '',
+  `body` text NOT NULL,
+  `status` varchar(10) NOT NULL DEFAULT 'pending',
+  `attempts` int(11) unsigned NOT NULL DEFAULT '0',
+  `next_attempt_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  `lease_owner` varchar(40) DEFAULT NULL,
+  `leased_until` timestamp NULL DEFAULT NULL,
+  `last_error` varchar(255) NOT NULL DEFAULT '',
+  `created_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `status` (`status`,`next_attempt_on`),
+  KEY `lease_owner` (`lease_owner`),
+  KEY `user_message_id` (`user_message_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
\ No newline at end of file
@@ -0,0 +1,15 @@
+CREATE TABLE `responder_rule` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `name` varchar(100) NOT NULL DEFAULT '',
+  `match_type` varchar(10) NOT NULL DEFAULT 'keyword',
+  `pattern` varchar(255) NOT NULL DEFAULT '',
+  `state` varchar(3) NOT NULL DEFAULT '',
+  `reply_slug` varchar(100) NOT NULL DEFAULT '',
+  `tag` varchar(50) NOT NULL DEFAULT '',
+  `attribute` varchar(255) NOT NULL DEFAULT '',
+  `priority` int(11) NOT NULL DEFAULT '0',
+  `enabled` tinyint(1) NOT NULL DEFAULT '0',
+  `created_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `enabled` (`enabled`,`priority`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
\ No newline at end of file
@@ -9,10 +9,13 @@ CREATE TABLE `user` (
   `created_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
   `landing_page` varchar(20) DEFAULT NULL,
   `message_window` varchar(10) DEFAULT 'afternoon',
+  `timezone` varchar(40) NOT NULL DEFAULT '',
   `news` tinyint(1) NOT NULL DEFAULT '0',
   `reminders` tinyint(1) NOT NULL DEFAULT '1',
+  `status` varchar(10) NOT NULL DEFAULT 'active',
   PRIMARY KEY (`id`),
   UNIQUE KEY `network` (`network`,`uuid`),
   KEY `landing_page` (`landing_page`),
-  KEY `state` (`state`)
+  KEY `state` (`state`),
+  KEY `status` (`status`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
\ No newline at end of file
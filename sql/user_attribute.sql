@@ -0,0 +1,8 @@
+CREATE TABLE `user_attribute` (
+  `user_id` int(11) unsigned NOT NULL,
+  `name` varchar(50) NOT NULL DEFAULT '',
+  `value` varchar(255) NOT NULL DEFAULT '',
+  `updated_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (`user_id`,`name`),
+  KEY `name` (`name`,`value`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
\ No newline at end of file
@@ -1,13 +1,30 @@
 CREATE TABLE `user_message` (
   `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
   `message_id` int(11) unsigned NOT NULL,
+  `message_version_id` int(11) unsigned DEFAULT NULL,
   `network` varchar(50) NOT NULL DEFAULT '',
   `uuid` varchar(100) NOT NULL DEFAULT '',
   `params` varchar(200) NOT NULL DEFAULT '',
   `send_on` timestamp NULL DEFAULT NULL,
   `sent` tinyint(1) NOT NULL DEFAULT '0',
+  `status` varchar(10) NOT NULL DEFAULT 'queued',
+  `status_detail` varchar(255) NOT NULL DEFAULT '',
+  `provider_id` varchar(64) NOT NULL DEFAULT '',
+  `body` text,
+  `transport` varchar(20) NOT NULL DEFAULT '',
+  `provider_response` varchar(255) NOT NULL DEFAULT '',
+  `sent_on` timestamp NULL DEFAULT NULL,
+  `flagged` tinyint(1) NOT NULL DEFAULT '0',
+  `unread` tinyint(1) NOT NULL DEFAULT '0',
+  `quiet_ok` tinyint(1) NOT NULL DEFAULT '0',
+  `campaign_id` int(11) unsigned DEFAULT NULL,
   `created_on` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
   PRIMARY KEY (`id`),
   KEY `message_id` (`message_id`),
-  KEY `network` (`network`,`uuid`)
+  KEY `network` (`network`,`uuid`),
+  KEY `provider_id` (`provider_id`),
+  KEY `status` (`status`,`send_on`),
+  KEY `unread` (`network`,`uuid`,`unread`),
+  KEY `campaign_id` (`campaign_id`,`status`),
+  UNIQUE KEY `campaign_recipient` (`campaign_id`,`uuid`,`network`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
\ No newline at end of file
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9_-]{1,50}$`)
+
+var tagSpacePattern = regexp.MustCompile(`\s+`)
+
+// Tags are lowercase labels; anything else is folded to lowercase, with
+// spaces as dashes ("Needs Ride" is needs-ride), and rejected if it still
+// isn't a valid tag.
+func NormalizeTag(tag string) (string, error) {
+	tag = tagSpacePattern.ReplaceAllString(strings.ToLower(strings.TrimSpace(tag)), "-")
+
+	if !tagPattern.MatchString(tag) {
+		return "", errors.New("Tags may only contain letters, numbers, dashes and underscores.")
+	}
+
+	return tag, nil
+}
+
+// Whether any user has the tag, i.e. an admin or a rule has used it.
+func TagExists(tag string) (bool, error) {
+	tag, err := NormalizeTag(tag)
+	if err != nil {
+		return false, err
+	}
+
+	db := NewMySQL()
+
+	result, err := db.Select("SELECT 1 FROM user_tag WHERE tag=? LIMIT 1", tag)
+	if err != nil {
+		return false, err
+	}
+
+	exists := false
+	for result.Next() {
+		exists = true
+	}
+
+	return exists, nil
+}
+
+func (this *User) AddTag(tag string) error {
+	if this.ID == 0 {
+		return errors.New("User must be saved before it can be tagged.")
+	}
+
+	tag, err := NormalizeTag(tag)
+	if err != nil {
+		return err
+	}
+
+	db := NewMySQL()
+
+	_, err = db.Insert("INSERT IGNORE INTO user_tag SET user_id=?, tag=?", this.ID, tag)
+
+	return err
+}
+
+func (this *User) RemoveTag(tag string) error {
+	db := NewMySQL()
+
+	tag, err := NormalizeTag(tag)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Update("DELETE FROM user_tag WHERE user_id=? AND tag=?", this.ID, tag)
+
+	return err
+}
+
+func (this *User) Tags() ([]string, error) {
+	db := NewMySQL()
+
+	tags := []string{}
+
+	result, err := db.Select("SELECT tag FROM user_tag WHERE user_id=? ORDER BY tag", this.ID)
+	if err != nil {
+		return tags, err
+	}
+
+	for result.Next() {
+		var tag string
+		if err := result.Scan(&tag); err != nil {
+			return tags, err
+		}
+
+		tags = append(tags, tag)
+	}
+
+	return tags, nil
+}
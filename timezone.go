@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var stateTimezones map[string]string = map[string]string{
+	"AL": "America/Chicago",
+	"AK": "America/Anchorage",
+	"AZ": "America/Phoenix",
+	"AR": "America/Chicago",
+	"CA": "America/Los_Angeles",
+	"CO": "America/Denver",
+	"CT": "America/New_York",
+	"DE": "America/New_York",
+	"DC": "America/New_York",
+	"FL": "America/New_York",
+	"GA": "America/New_York",
+	"HI": "Pacific/Honolulu",
+	"ID": "America/Boise",
+	"IL": "America/Chicago",
+	"IN": "America/Indiana/Indianapolis",
+	"IA": "America/Chicago",
+	"KS": "America/Chicago",
+	"KY": "America/New_York",
+	"LA": "America/Chicago",
+	"ME": "America/New_York",
+	"MD": "America/New_York",
+	"MA": "America/New_York",
+	"MI": "America/Detroit",
+	"MN": "America/Chicago",
+	"MS": "America/Chicago",
+	"MO": "America/Chicago",
+	"MT": "America/Denver",
+	"NE": "America/Chicago",
+	"NV": "America/Los_Angeles",
+	"NH": "America/New_York",
+	"NJ": "America/New_York",
+	"NM": "America/Denver",
+	"NY": "America/New_York",
+	"NC": "America/New_York",
+	"ND": "America/Chicago",
+	"OH": "America/New_York",
+	"OK": "America/Chicago",
+	"OR": "America/Los_Angeles",
+	"PA": "America/New_York",
+	"RI": "America/New_York",
+	"SC": "America/New_York",
+	"SD": "America/Chicago",
+	"TN": "America/Chicago",
+	"TX": "America/Chicago",
+	"UT": "America/Denver",
+	"VT": "America/New_York",
+	"VA": "America/New_York",
+	"WA": "America/Los_Angeles",
+	"WV": "America/New_York",
+	"WI": "America/Chicago",
+	"WY": "America/Denver",
+	"PR": "America/Puerto_Rico",
+	"VI": "America/St_Thomas",
+	"GU": "Pacific/Guam",
+}
+
+var zipTimezonesMutex sync.RWMutex
+var zipTimezones map[string]string = map[string]string{}
+
+// Loads the zipcode time zone table. It's a CSV of zip,timezone rows, where
+// zip is a three digit prefix or, for prefixes split between zones, a full
+// five digit zipcode.
+func LoadZipTimezones(path string) error {
+	_, rows, err := readCalendarCSV(path)
+	if err != nil {
+		return err
+	}
+
+	table := map[string]string{}
+
+	for i, row := range rows {
+		if len(row) < 2 || (len(row[0]) != 3 && len(row[0]) != 5) {
+			return fmt.Errorf("%s line %d: expected a 3 or 5 digit zip and a time zone", path, i+2)
+		}
+
+		if _, err := time.LoadLocation(row[1]); err != nil {
+			return fmt.Errorf("%s line %d: unknown time zone %s", path, i+2, row[1])
+		}
+
+		table[row[0]] = row[1]
+	}
+
+	zipTimezonesMutex.Lock()
+	zipTimezones = table
+	zipTimezonesMutex.Unlock()
+
+	log.Printf("Loaded %d zipcode time zones.\n", len(table))
+
+	return nil
+}
+
+// Returns the IANA time zone for a state and zipcode: the zipcode's own
+// entry, then its three digit prefix's, then the state's. Returns "" when
+// none of them are known.
+func TimezoneFor(state string, zipcode int) string {
+	if zipcode > 0 {
+		zip := fmt.Sprintf("%05d", zipcode)
+
+		zipTimezonesMutex.RLock()
+		tz, ok := zipTimezones[zip]
+		if !ok {
+			tz, ok = zipTimezones[zip[:3]]
+		}
+		zipTimezonesMutex.RUnlock()
+
+		if ok {
+			return tz
+		}
+	}
+
+	if tz, ok := stateTimezones[state]; ok {
+		return tz
+	}
+
+	return ""
+}
+
+func LoadLocationOrLocal(name string) *time.Location {
+	if loc, err := time.LoadLocation(name); err == nil {
+		return loc
+	}
+
+	loc, _ := time.LoadLocation("Local")
+	return loc
+}
+
+// Reinterprets the wall clock time of t in loc.
+func InLocation(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type Recipient struct {
+	UUID    string
+	Network string
+}
+
+// Address returns the carrier gateway email address for the recipient.
+func (this *Recipient) Address() string {
+	domain := NetworkToDomain(this.Network)
+	if domain == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(domain, this.UUID)
+}
+
+type DeliveryResult struct {
+	Transport  string
+	ProviderID string
+	Response   string
+	SentOn     time.Time
+}
+
+type Transport interface {
+	Name() string
+	Send(ctx context.Context, recipient *Recipient, body string) (*DeliveryResult, error)
+}
+
+var transports map[string]Transport = map[string]Transport{
+	"ses":    &SESTransport{},
+	"smtp":   &SMTPTransport{},
+	"gmail":  &GmailTransport{},
+	"twilio": &SMSTransport{},
+}
+
+var networkTransports map[string]string = map[string]string{}
+
+// Reads -transport and -network-transports, e.g. "verizon=smtp&att=ses".
+// Called once at startup so a typo stops the server instead of a send worker.
+func loadNetworkTransports() error {
+	if _, ok := transports[*DefaultTransport]; !ok {
+		return errors.New("Unknown -transport: " + *DefaultTransport)
+	}
+
+	overrides := map[string]string{}
+
+	for _, entry := range strings.Split(*NetworkTransports, "&") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return errors.New("Invalid network transport, use network=transport: " + entry)
+		}
+
+		if _, ok := transports[kv[1]]; !ok {
+			return errors.New("Unknown transport for " + kv[0] + ": " + kv[1])
+		}
+
+		overrides[kv[0]] = kv[1]
+	}
+
+	networkTransports = overrides
+
+	return nil
+}
+
+// Picks the transport for a network, falling back to the deployment default.
+// Networks without a carrier gateway can only be reached over SMS.
+func TransportForNetwork(network string) (Transport, error) {
+	name := *DefaultTransport
+	if NetworkToDomain(network) == "" {
+		name = "twilio"
+	}
+
+	if v, ok := networkTransports[network]; ok {
+		name = v
+	}
+
+	if t, ok := transports[name]; ok {
+		return t, nil
+	}
+
+	return nil, errors.New("Unknown transport: " + name)
+}
+
+type SESTransport struct{}
+
+func (this *SESTransport) Name() string {
+	return "ses"
+}
+
+func (this *SESTransport) Send(ctx context.Context, recipient *Recipient, body string) (*DeliveryResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	email := &Email{
+		From: "sms@iwillvote.us",
+		To:   recipient.Address(),
+		Body: body,
+	}
+
+	if email.To == "" {
+		return nil, errors.New("No gateway address for network: " + recipient.Network)
+	}
+
+	id, err := sendSES(email)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeliveryResult{Transport: this.Name(), ProviderID: id, SentOn: time.Now()}, nil
+}
+
+// Generic SMTP relay, configured with SMTP_HOST, SMTP_PORT, SMTP_USERNAME
+// and SMTP_PASSWORD. Leave the credentials blank for a local stand-in.
+type SMTPTransport struct{}
+
+func (this *SMTPTransport) Name() string {
+	return "smtp"
+}
+
+func (this *SMTPTransport) Send(ctx context.Context, recipient *Recipient, body string) (*DeliveryResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, errors.New("SMTP not configured.")
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "25"
+	}
+
+	email := &Email{
+		From: "sms@iwillvote.us",
+		To:   recipient.Address(),
+		Body: body,
+	}
+
+	if email.To == "" {
+		return nil, errors.New("No gateway address for network: " + recipient.Network)
+	}
+
+	if err := sendSMTP(email, host, port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD")); err != nil {
+		return nil, err
+	}
+
+	return &DeliveryResult{Transport: this.Name(), SentOn: time.Now()}, nil
+}
+
+type GmailTransport struct{}
+
+func (this *GmailTransport) Name() string {
+	return "gmail"
+}
+
+func (this *GmailTransport) Send(ctx context.Context, recipient *Recipient, body string) (*DeliveryResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	email := &Email{
+		To:   recipient.Address(),
+		Body: body,
+	}
+
+	if email.To == "" {
+		return nil, errors.New("No gateway address for network: " + recipient.Network)
+	}
+
+	if err := sendGmail(email); err != nil {
+		return nil, err
+	}
+
+	return &DeliveryResult{Transport: this.Name(), SentOn: time.Now()}, nil
+}
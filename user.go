@@ -119,7 +119,9 @@ func GetUsersCountByState() (map[string]int64, error) {
 	return count, nil
 }
 
-func ListUsers(landing string, state string, sort string, limit int64, offset int64) ([]*User, error) {
+// Lists users, optionally filtered by landing page, state, a tag and an
+// attribute expression like "household_size>=3".
+func ListUsers(landing string, state string, tag string, attribute string, sort string, limit int64, offset int64) ([]*User, error) {
 	db := NewMySQL()
 
 	var userList []*User
@@ -137,6 +139,26 @@ func ListUsers(landing string, state string, sort string, limit int64, offset in
 		whereVars = append(whereVars, state)
 	}
 
+	if tag != "" {
+		tag, err := NormalizeTag(tag)
+		if err != nil {
+			return userList, err
+		}
+
+		where = append(where, "EXISTS (SELECT 1 FROM user_tag AS t WHERE t.user_id = u.id AND t.tag = ?)")
+		whereVars = append(whereVars, tag)
+	}
+
+	if attribute != "" {
+		cond, condVars, err := attributeExprCondition(attribute)
+		if err != nil {
+			return userList, err
+		}
+
+		where = append(where, cond)
+		whereVars = append(whereVars, condVars...)
+	}
+
 	validSort := map[string]bool{"created_on": true, "name": true, "uuid": true}
 	if _, ok := validSort[sort]; !ok {
 		sort = "created_on"
@@ -152,8 +174,8 @@ func ListUsers(landing string, state string, sort string, limit int64, offset in
 	whereVars = append(whereVars, offset, limit)
 
 	result, err := db.Select(`SELECT
-		id, network, uuid, name, state, zipcode, created_on, deleted, landing_page, message_window, news, reminders
-		FROM user WHERE `+whereStr+` ORDER BY `+sort+` DESC LIMIT ?, ?`,
+		id, network, uuid, name, state, zipcode, created_on, deleted, landing_page, message_window, timezone, news, reminders, status
+		FROM user AS u WHERE `+whereStr+` ORDER BY `+sort+` DESC LIMIT ?, ?`,
 		whereVars...)
 	if err != nil {
 		return userList, err
@@ -161,7 +183,60 @@ func ListUsers(landing string, state string, sort string, limit int64, offset in
 
 	for result.Next() {
 		u := &User{}
-		err := result.Scan(&u.ID, &u.Network, &u.UUID, &u.Name, &u.State, &u.Zipcode, &u.CreatedOn, &u.Deleted, &u.LandingPage, &u.MessageWindow, &u.News, &u.Reminders)
+		err := result.Scan(&u.ID, &u.Network, &u.UUID, &u.Name, &u.State, &u.Zipcode, &u.CreatedOn, &u.Deleted, &u.LandingPage, &u.MessageWindow, &u.Timezone, &u.News, &u.Reminders, &u.Status)
+		if err != nil {
+			return userList, err
+		}
+
+		userList = append(userList, u)
+	}
+
+	return userList, nil
+}
+
+// Finds the user with a phone number, preferring an exact network match, then
+// active users, then the most recent signup.
+func FindUserByPhone(uuid string, network string) (*User, error) {
+	db := NewMySQL()
+
+	result, err := db.Select(`SELECT
+		id, network, uuid, name, state, zipcode, created_on, deleted, landing_page, message_window, timezone, news, reminders, status
+		FROM user WHERE uuid = ? ORDER BY network = ? DESC, deleted ASC, created_on DESC LIMIT 1`,
+		uuid, network)
+	if err != nil {
+		return nil, err
+	}
+
+	for result.Next() {
+		u := &User{}
+		err := result.Scan(&u.ID, &u.Network, &u.UUID, &u.Name, &u.State, &u.Zipcode, &u.CreatedOn, &u.Deleted, &u.LandingPage, &u.MessageWindow, &u.Timezone, &u.News, &u.Reminders, &u.Status)
+		if err != nil {
+			return nil, err
+		}
+
+		return u, nil
+	}
+
+	return nil, nil
+}
+
+// Confirmed, non-deleted users in a state who want reminders, paged by id.
+func ListReminderUsers(state string, afterID int64, limit int64) ([]*User, error) {
+	db := NewMySQL()
+
+	var userList []*User
+
+	result, err := db.Select(`SELECT
+		id, network, uuid, name, state, zipcode, created_on, deleted, landing_page, message_window, timezone, news, reminders, status
+		FROM user WHERE state = ? AND deleted = 0 AND reminders = 1 AND status = ? AND id > ? ORDER BY id LIMIT ?`,
+		state, UserActive, afterID, limit)
+	if err != nil {
+		return userList, err
+	}
+
+	for result.Next() {
+		u := &User{}
+		err := result.Scan(&u.ID, &u.Network, &u.UUID, &u.Name, &u.State, &u.Zipcode, &u.CreatedOn, &u.Deleted, &u.LandingPage, &u.MessageWindow, &u.Timezone, &u.News, &u.Reminders, &u.Status)
 		if err != nil {
 			return userList, err
 		}
@@ -172,6 +247,14 @@ func ListUsers(landing string, state string, sort string, limit int64, offset in
 	return userList, nil
 }
 
+// Hours of the day, [start, end), each message window covers in the
+// recipient's local time.
+var messageWindows map[string][2]int = map[string][2]int{
+	"morning":   {8, 12},
+	"afternoon": {12, 17},
+	"evening":   {17, 21},
+}
+
 type User struct {
 	ID            int64  `json:"id"`
 	Network       string `json:"network"`
@@ -183,10 +266,20 @@ type User struct {
 	Deleted       int    `json:"deleted"`
 	LandingPage   string `json:"landing_page"`
 	MessageWindow string `json:"message_window"`
+	Timezone      string `json:"timezone"`
 	News          int    `json:"news_feed"`
 	Reminders     int    `json:"reminders"`
+	Status        string `json:"status"`
+	vars          map[string]string
 }
 
+// Signups stay pending until the user confirms, and expire if they never do.
+const (
+	UserPending = "pending"
+	UserActive  = "active"
+	UserExpired = "expired"
+)
+
 func (this *User) IsComplete() error {
 	if this.Network != "" && this.UUID != "" {
 		_, err := regexp.MatchString("^\\d{10}$", this.UUID)
@@ -205,9 +298,20 @@ func (this *User) Save() error {
 
 	var err error
 
+	if this.Timezone == "" {
+		this.Timezone = TimezoneFor(this.State, this.Zipcode)
+		if this.Timezone == "" {
+			log.Printf("No time zone for %s@%s in %q %05d, using the server's.\n", this.UUID, this.Network, this.State, this.Zipcode)
+		}
+	}
+
+	if this.Status == "" {
+		this.Status = UserActive
+	}
+
 	if this.ID == 0 {
 		newID, err := db.Insert(
-			"INSERT INTO user SET network=?, uuid=?, name=?, state=?, zipcode=?, deleted=?, landing_page=?, message_window=?, news=?, reminders=?",
+			"INSERT INTO user SET network=?, uuid=?, name=?, state=?, zipcode=?, deleted=?, landing_page=?, message_window=?, timezone=?, news=?, reminders=?, status=?",
 			this.Network,
 			this.UUID,
 			this.Name,
@@ -216,8 +320,10 @@ func (this *User) Save() error {
 			this.Deleted,
 			this.LandingPage,
 			this.MessageWindow,
+			this.Timezone,
 			this.News,
 			this.Reminders,
+			this.Status,
 		)
 
 		if err == nil {
@@ -225,7 +331,7 @@ func (this *User) Save() error {
 		}
 	} else {
 		_, err = db.Update(
-			"UPDATE user SET network=?, uuid=?, name=?, state=?, zipcode=?, deleted=?, landing_page=?, message_window=?, news=?, reminders=? WHERE id=?",
+			"UPDATE user SET network=?, uuid=?, name=?, state=?, zipcode=?, deleted=?, landing_page=?, message_window=?, timezone=?, news=?, reminders=?, status=? WHERE id=?",
 			this.Network,
 			this.UUID,
 			this.Name,
@@ -234,8 +340,10 @@ func (this *User) Save() error {
 			this.Deleted,
 			this.LandingPage,
 			this.MessageWindow,
+			this.Timezone,
 			this.News,
 			this.Reminders,
+			this.Status,
 			this.ID,
 		)
 	}
@@ -263,13 +371,13 @@ func (this *User) Load() error {
 		return errors.New("Message missing required fields for load: id or network and uuid")
 	}
 
-	result, err := db.Select("SELECT id, network, uuid, name, state, zipcode, created_on, deleted, landing_page, message_window, news, reminders FROM user WHERE "+where+" LIMIT 1", params...)
+	result, err := db.Select("SELECT id, network, uuid, name, state, zipcode, created_on, deleted, landing_page, message_window, timezone, news, reminders, status FROM user WHERE "+where+" LIMIT 1", params...)
 	if err != nil {
 		return err
 	}
 
 	for result.Next() {
-		err = result.Scan(&this.ID, &this.Network, &this.UUID, &this.Name, &this.State, &this.Zipcode, &this.CreatedOn, &this.Deleted, &this.LandingPage, &this.MessageWindow, &this.News, &this.Reminders)
+		err = result.Scan(&this.ID, &this.Network, &this.UUID, &this.Name, &this.State, &this.Zipcode, &this.CreatedOn, &this.Deleted, &this.LandingPage, &this.MessageWindow, &this.Timezone, &this.News, &this.Reminders, &this.Status)
 		if err != nil {
 			log.Println(err.Error())
 			return err
@@ -283,8 +391,84 @@ func (this *User) Load() error {
 	return nil
 }
 
-func (this *User) Unsubscribe() error {
+// Subscription changes are recorded in the consent ledger. Unsubscribing
+// also cancels anything queued or scheduled for the user, before the ledger
+// entry so nothing is left to go out if recording it fails.
+func (this *User) Unsubscribe(consent *Consent) error {
 	this.Deleted = 1
-	err := this.Save()
-	return err
+	if err := this.Save(); err != nil {
+		return err
+	}
+
+	if err := this.cancelSends("User unsubscribed."); err != nil {
+		return err
+	}
+
+	return consent.Record(this)
+}
+
+// Cancels the user's queued and scheduled messages and their pending
+// deliveries.
+func (this *User) cancelSends(detail string) error {
+	db := NewMySQL()
+
+	_, err := db.Update(
+		"UPDATE user_message SET status=?, status_detail=? WHERE uuid=? AND network=? AND status=?",
+		DeliveryCancelled,
+		detail,
+		this.UUID,
+		this.Network,
+		DeliveryQueued,
+	)
+	if err != nil {
+		return err
+	}
+
+	return CancelRecipientDeliveries(this.UUID, this.Network, detail)
+}
+
+func (this *User) Resubscribe(consent *Consent) error {
+	this.Deleted = 0
+	if err := this.Save(); err != nil {
+		return err
+	}
+
+	return consent.Record(this)
+}
+
+// The user's time zone, derived from state and zipcode for users saved
+// before time zones were recorded. Users whose zone couldn't be worked out
+// get the server's.
+func (this *User) Location() *time.Location {
+	tz := this.Timezone
+	if tz == "" {
+		tz = TimezoneFor(this.State, this.Zipcode)
+	}
+
+	if tz == "" {
+		return time.Local
+	}
+
+	return LoadLocationOrLocal(tz)
+}
+
+// Returns t if it falls inside the user's message window, otherwise the start
+// of the next window after t.
+func (this *User) NextSendTime(t time.Time) time.Time {
+	window, ok := messageWindows[this.MessageWindow]
+	if !ok {
+		window = messageWindows["afternoon"]
+	}
+
+	local := t.In(this.Location())
+	if local.Hour() >= window[0] && local.Hour() < window[1] {
+		return t
+	}
+
+	start := time.Date(local.Year(), local.Month(), local.Day(), window[0], 0, 0, 0, local.Location())
+	if !start.After(local) {
+		start = start.AddDate(0, 0, 1)
+	}
+
+	return start
 }
@@ -3,8 +3,13 @@ package main
 import (
 	"fmt"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
+// MySQL timestamps are read and written in the server's zone.
+const dbTimeFormat = "2006-01-02 15:04:05"
+
 func Mapify(in string) map[string]string {
 	if in == "" {
 		return map[string]string{}
@@ -32,3 +37,26 @@ func Stringify(in map[string]string) string {
 
 	return strings.Join(out, "&")
 }
+
+// Shortens s to at most n bytes, cutting at the start of a character so a
+// varchar column never gets half of one.
+func Truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+func ParseDBTime(in string) (time.Time, error) {
+	loc, _ := time.LoadLocation("Local")
+	return time.ParseInLocation(dbTimeFormat, in, loc)
+}
+
+func FormatDBTime(t time.Time) string {
+	return t.Local().Format(dbTimeFormat)
+}
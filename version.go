@@ -0,0 +1,199 @@
+package main
+
+import (
+	"regexp"
+)
+
+// Each edit of an outgoing message is kept as a new version, and every
+// user_message records the version it went out as, so a thread shows exactly
+// what was sent even after the message has changed.
+type MessageVersion struct {
+	ID        int64       `json:"id"`
+	MessageID int64       `json:"message_id"`
+	Version   int         `json:"version"`
+	Slug      string      `json:"slug"`
+	Message   string      `json:"message"`
+	CreatedBy string      `json:"created_by"`
+	CreatedOn string      `json:"created_on"`
+	Diff      []*DiffPart `json:"diff"`
+}
+
+// Newest first, each with its diff from the version before it.
+func GetMessageVersions(messageID int64) ([]*MessageVersion, error) {
+	db := NewMySQL()
+
+	result, err := db.Select(`SELECT id, message_id, version, slug, message, created_by, created_on
+		FROM message_version WHERE message_id=? ORDER BY version ASC`, messageID)
+	if err != nil {
+		return []*MessageVersion{}, err
+	}
+
+	versions := []*MessageVersion{}
+	prev := ""
+
+	for result.Next() {
+		v := &MessageVersion{}
+
+		err := result.Scan(&v.ID, &v.MessageID, &v.Version, &v.Slug, &v.Message, &v.CreatedBy, &v.CreatedOn)
+		if err != nil {
+			return versions, err
+		}
+
+		v.Diff = DiffWords(prev, v.Message)
+		prev = v.Message
+
+		versions = append([]*MessageVersion{v}, versions...)
+	}
+
+	return versions, nil
+}
+
+// Messages from before versions were kept have none, see
+// sql/backfill_message_version.sql. Before one is first edited its text as
+// it was becomes version 1, and the sends that went out with it are pinned
+// to it.
+func (this *Message) snapshotVersion() error {
+	db := NewMySQL()
+
+	newID, err := db.Insert(
+		`INSERT IGNORE INTO message_version (message_id, version, slug, message, created_by, created_on)
+		SELECT id, 1, slug, message, '', created_on FROM message WHERE id=? AND version_id IS NULL`,
+		this.ID,
+	)
+	if err != nil || newID == 0 {
+		return err
+	}
+
+	if _, err := db.Update("UPDATE message SET version_id=? WHERE id=?", newID, this.ID); err != nil {
+		return err
+	}
+
+	if _, err := db.Update("UPDATE user_message SET message_version_id=? WHERE message_id=? AND message_version_id IS NULL", newID, this.ID); err != nil {
+		return err
+	}
+
+	this.VersionID = newID
+
+	return nil
+}
+
+// Records the message's current slug and text as its next version, unless
+// they're unchanged from the latest one.
+func (this *Message) saveVersion() error {
+	db := NewMySQL()
+
+	if this.VersionID != 0 {
+		result, err := db.Select("SELECT slug, message FROM message_version WHERE id=? LIMIT 1", this.VersionID)
+		if err != nil {
+			return err
+		}
+
+		unchanged := false
+		for result.Next() {
+			var slug, message string
+			if err := result.Scan(&slug, &message); err != nil {
+				return err
+			}
+
+			unchanged = slug == this.Slug && message == this.Message
+		}
+
+		if unchanged {
+			return nil
+		}
+	}
+
+	newID, err := db.Insert(
+		`INSERT INTO message_version (message_id, version, slug, message, created_by)
+		SELECT ?, IFNULL(MAX(version), 0) + 1, ?, ?, ? FROM message_version WHERE message_id=?`,
+		this.ID,
+		this.Slug,
+		this.Message,
+		this.Author,
+		this.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Update("UPDATE message SET version_id=? WHERE id=?", newID, this.ID); err != nil {
+		return err
+	}
+
+	this.VersionID = newID
+
+	return nil
+}
+
+type DiffPart struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+const (
+	DiffSame   = "="
+	DiffInsert = "+"
+	DiffDelete = "-"
+)
+
+var diffTokenPattern = regexp.MustCompile(`\s+|[^\s]+`)
+
+// A word by word diff from a to b, from their longest common subsequence.
+func DiffWords(a string, b string) []*DiffPart {
+	x := diffTokenPattern.FindAllString(a, -1)
+	y := diffTokenPattern.FindAllString(b, -1)
+
+	// lcs[i][j] is the common length of x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	parts := []*DiffPart{}
+	add := func(op string, text string) {
+		if n := len(parts); n > 0 && parts[n-1].Op == op {
+			parts[n-1].Text += text
+			return
+		}
+
+		parts = append(parts, &DiffPart{Op: op, Text: text})
+	}
+
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			add(DiffSame, x[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			add(DiffDelete, x[i])
+			i++
+		default:
+			add(DiffInsert, y[j])
+			j++
+		}
+	}
+
+	for ; i < len(x); i++ {
+		add(DiffDelete, x[i])
+	}
+
+	for ; j < len(y); j++ {
+		add(DiffInsert, y[j])
+	}
+
+	return parts
+}
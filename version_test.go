@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffWords(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want string
+	}{
+		{"both empty", "", "", ""},
+		{"to empty", "vote early", "", "-vote early"},
+		{"from empty", "", "vote early", "+vote early"},
+		{"identical", "vote early", "vote early", "=vote early"},
+		{"word changed", "vote on Tuesday", "vote on Wednesday", "=vote on |-Tuesday|+Wednesday"},
+		{"word added", "vote early", "vote early today", "=vote early|+ today"},
+		{"spacing changed", "vote  early", "vote early", "=vote|-  |+ |=early"},
+	}
+
+	for _, tt := range tests {
+		parts := []string{}
+		for _, p := range DiffWords(tt.a, tt.b) {
+			parts = append(parts, p.Op+p.Text)
+		}
+
+		if got := strings.Join(parts, "|"); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Webhooks are only accepted with ?token= matching WEBHOOK_TOKEN, which
+// should be part of the URL registered with SNS and the SMS provider.
+func webhookAuthorized(r *http.Request) bool {
+	token := os.Getenv("WEBHOOK_TOKEN")
+	if token == "" {
+		log.Println("WEBHOOK_TOKEN not configured, rejecting webhook.")
+		return false
+	}
+
+	return r.URL.Query().Get("token") == token
+}
+
+type snsEnvelope struct {
+	Type         string `json:"Type"`
+	Message      string `json:"Message"`
+	SubscribeURL string `json:"SubscribeURL"`
+}
+
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	Mail             struct {
+		MessageID string `json:"messageId"`
+	} `json:"mail"`
+	Bounce struct {
+		BounceType        string `json:"bounceType"`
+		BouncedRecipients []struct {
+			DiagnosticCode string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Delivery struct {
+		SMTPResponse string `json:"smtpResponse"`
+	} `json:"delivery"`
+}
+
+// Accepts SES bounce and delivery notifications published through SNS.
+func sesWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !webhookAuthorized(r) {
+		http.Error(w, "Forbidden.", 403)
+		return
+	}
+
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad request.", 400)
+		return
+	}
+
+	envelope := &snsEnvelope{}
+	if err := json.Unmarshal(raw, envelope); err != nil {
+		log.Println(err.Error())
+		http.Error(w, "Bad request.", 400)
+		return
+	}
+
+	switch envelope.Type {
+	case "SubscriptionConfirmation":
+		confirmSNSSubscription(envelope.SubscribeURL)
+	case "Notification":
+		notification := &sesNotification{}
+		if err := json.Unmarshal([]byte(envelope.Message), notification); err != nil {
+			log.Println(err.Error())
+			http.Error(w, "Bad request.", 400)
+			return
+		}
+
+		status := ""
+		detail := ""
+
+		switch notification.NotificationType {
+		case "Delivery":
+			status = DeliveryDelivered
+			detail = notification.Delivery.SMTPResponse
+		case "Bounce":
+			status = DeliveryBounced
+			detail = notification.Bounce.BounceType
+			if len(notification.Bounce.BouncedRecipients) > 0 {
+				detail += ": " + notification.Bounce.BouncedRecipients[0].DiagnosticCode
+			}
+		default:
+			log.Printf("Ignoring SES notification type: %s\n", notification.NotificationType)
+		}
+
+		if status != "" {
+			updateDeliveryStatus(notification.Mail.MessageID, status, detail)
+		}
+	}
+
+	w.WriteHeader(200)
+}
+
+func confirmSNSSubscription(subscribeURL string) {
+	u, err := url.Parse(subscribeURL)
+	if err != nil || u.Scheme != "https" || !strings.HasSuffix(u.Host, ".amazonaws.com") {
+		log.Printf("Refusing SNS subscription URL: %s\n", subscribeURL)
+		return
+	}
+
+	resp, err := http.Get(subscribeURL)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	resp.Body.Close()
+
+	log.Println("Confirmed SNS subscription.")
+}
+
+var smsCallbackStatuses map[string]string = map[string]string{
+	"sent":        DeliverySent,
+	"delivered":   DeliveryDelivered,
+	"undelivered": DeliveryFailed,
+	"failed":      DeliveryFailed,
+}
+
+// Accepts Twilio-style status callbacks for the SMS transport.
+func smsStatusWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !webhookAuthorized(r) {
+		http.Error(w, "Forbidden.", 403)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Bad request.", 400)
+		return
+	}
+
+	if status, ok := smsCallbackStatuses[r.FormValue("MessageStatus")]; ok {
+		detail := r.FormValue("MessageStatus")
+		if code := r.FormValue("ErrorCode"); code != "" {
+			detail += ": error " + code
+		}
+
+		updateDeliveryStatus(r.FormValue("MessageSid"), status, detail)
+	}
+
+	w.WriteHeader(204)
+}
+
+func updateDeliveryStatus(providerID string, status string, detail string) {
+	mt, err := GetMessageToByProviderID(providerID)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	changed, err := mt.SetStatus(status, detail)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	if !changed {
+		log.Printf("Ignoring %s for message %d, currently %s.\n", status, mt.ID, mt.Status)
+	}
+}
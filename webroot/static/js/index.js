@@ -16,13 +16,12 @@ jQuery(document).ready(function() {
         data: {
           name: jQuery('#nameInput').val(),
           uuid: jQuery('#uuidInput').val(),
-          network: jQuery('#networkInput').val(),
           state: jQuery('#stateInput').val(),
           window: jQuery('#windowInput').val(),
           landing_page: jQuery('#landingInput').val()
         },
         success: function(data) {
-          jQuery("form#addUser").parent().prepend("<div class=\"alert alert-success\" role=\"alert\">You're all set! We'll remind you when it's time to vote!</alert>");
+          jQuery("form#addUser").parent().prepend("<div class=\"alert alert-success\" role=\"alert\">Almost done! Reply YES to the text we just sent you to confirm your signup.</alert>");
         },
         error: function() {
           jQuery("form#addUser").parent().prepend("<div class=\"alert alert-warning\" role=\"alert\">We're having trouble creating your account. Please try again later.</alert>");